@@ -0,0 +1,451 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrInvalidJob  = errors.New("invalid job")
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobRunning  = errors.New("job is running")
+)
+
+// AtSource is the source name of the one-shot jobs, that used in the log and metrics.
+const AtSource = "at"
+
+// maxJobSize is the maximum size of a request body to submit a job.
+const maxJobSize = 1 << 20
+
+// AtJob is a one-shot job that runs only once at the specified time, like at(1).
+type AtJob struct {
+	ID      string            `json:"id"`
+	At      time.Time         `json:"at"`
+	User    string            `json:"user,omitempty"`
+	Command string            `json:"command"`
+	Stdin   string            `json:"stdin,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Created time.Time         `json:"created"`
+}
+
+// Validate checks if the job has all required fields.
+func (j AtJob) Validate() error {
+	if j.At.IsZero() {
+		return fmt.Errorf("%w: at is required", ErrInvalidJob)
+	}
+	if strings.TrimSpace(j.Command) == "" {
+		return fmt.Errorf("%w: command is required", ErrInvalidJob)
+	}
+	for k := range j.Env {
+		if !IsValidKey(k) {
+			return fmt.Errorf("%w: invalid environment variable name: %q", ErrInvalidJob, k)
+		}
+	}
+	return nil
+}
+
+// AtStr returns the time to run in a human readable string.
+func (j AtJob) AtStr() string {
+	return humanize.Time(j.At)
+}
+
+// Task makes a Task to run the job.
+// The base is the environment variables that the job's Env is added to.
+func (j AtJob) Task(base Environ) (Task, error) {
+	env := append(Environ{}, base...)
+	keys := make([]string, 0, len(j.Env))
+	for k := range j.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env.Set(k + "=" + j.Env[k])
+	}
+
+	user := j.User
+	if user == "" {
+		user = "*"
+	}
+
+	t := Task{
+		Source:       AtSource,
+		ScheduleSpec: "@at",
+		ResolvedSpec: "@at",
+		Schedule:     AtSchedule{At: j.At},
+		User:         user,
+		Command:      strings.TrimSpace(j.Command),
+		Stdin:        j.Stdin,
+		Env:          env,
+	}
+	if err := t.parseOptions(env); err != nil {
+		return Task{}, err
+	}
+	if t.IsTriggered() {
+		return Task{}, errors.New("AFTER and AFTER_FAILURE can not be used in a job")
+	}
+
+	// The job runs only once, so it doesn't need to catch up.
+	t.CatchUp = false
+
+	id := crc64.New(hashTable)
+	id.Write([]byte(AtSource + "\n" + j.ID))
+	t.ID = id.Sum64()
+
+	return t, nil
+}
+
+// AtSchedule is a cron.Schedule that activates only once at the time.
+type AtSchedule struct {
+	At time.Time
+}
+
+// Next implements cron.Schedule.
+func (s AtSchedule) Next(t time.Time) time.Time {
+	if t.Before(s.At) {
+		return s.At
+	}
+	return time.Time{}
+}
+
+type atEntry struct {
+	Job     AtJob
+	Task    Task
+	Entry   cron.EntryID
+	Running bool
+}
+
+// AtQueue is a queue of AtJob.
+//
+// The jobs are stored in the spool directory, one file per job, so they survive restarts of Concron.
+// A job is removed from the queue after it ran.
+// If Concron was down at the time of a job, the job runs as soon as the AtQueue is opened.
+//
+// AtQueue also serves the HTTP API to submit, list, and cancel jobs.
+type AtQueue struct {
+	sync.Mutex
+
+	Dir string
+
+	token     string
+	env       Environ
+	scheduler *Scheduler
+	sm        *StatusMonitor
+	entries   map[string]*atEntry
+}
+
+// OpenAtQueue opens the spool directory, and schedules the stored jobs.
+// The directory is created when the first job is submitted.
+//
+// The token is required to use the HTTP API. If it is empty, the HTTP API is disabled.
+// The env is the base environment variables of the jobs.
+func OpenAtQueue(dir, token string, env Environ, s *Scheduler, sm *StatusMonitor) (*AtQueue, error) {
+	q := &AtQueue{
+		Dir:       dir,
+		token:     token,
+		env:       env,
+		scheduler: s,
+		sm:        sm,
+		entries:   make(map[string]*atEntry),
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		var j AtJob
+		raw, err := os.ReadFile(f)
+		if err == nil {
+			err = json.Unmarshal(raw, &j)
+		}
+		if err == nil {
+			err = q.schedule(j)
+		}
+		if err != nil {
+			sm.L().Error("failed to load job", zap.String("path", f), zap.Error(err))
+		}
+	}
+
+	return q, nil
+}
+
+// Jobs returns the jobs in the queue, in order of the time to run.
+func (q *AtQueue) Jobs() []AtJob {
+	q.Lock()
+	defer q.Unlock()
+
+	js := make([]AtJob, 0, len(q.entries))
+	for _, e := range q.entries {
+		js = append(js, e.Job)
+	}
+	sort.Slice(js, func(i, j int) bool {
+		if js[i].At.Equal(js[j].At) {
+			return js[i].ID < js[j].ID
+		}
+		return js[i].At.Before(js[j].At)
+	})
+	return js
+}
+
+// Submit adds a new job to the queue.
+// The ID and Created of the job are set by the queue.
+func (q *AtQueue) Submit(j AtJob) (AtJob, error) {
+	if err := j.Validate(); err != nil {
+		return AtJob{}, err
+	}
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return AtJob{}, err
+	}
+	j.ID = hex.EncodeToString(id[:])
+	j.Created = time.Now()
+
+	if err := q.save(j); err != nil {
+		return AtJob{}, err
+	}
+	if err := q.schedule(j); err != nil {
+		os.Remove(q.path(j.ID))
+		return AtJob{}, err
+	}
+
+	q.logger(j).Info("job submitted", zap.Time("at", j.At))
+
+	return j, nil
+}
+
+// Cancel removes a job that not started yet from the queue.
+func (q *AtQueue) Cancel(id string) error {
+	// Check and forget the job at once, to not cancel the job that starts in between.
+	q.Lock()
+	e, ok := q.entries[id]
+	if !ok {
+		q.Unlock()
+		return fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	if e.Running {
+		q.Unlock()
+		return fmt.Errorf("%w: %s", ErrJobRunning, id)
+	}
+	q.forget(id)
+	q.Unlock()
+
+	if err := q.removeFile(id); err != nil {
+		return err
+	}
+
+	q.logger(e.Job).Info("job canceled", zap.Time("at", e.Job.At))
+
+	return nil
+}
+
+func (q *AtQueue) path(id string) string {
+	return filepath.Join(q.Dir, id+".json")
+}
+
+func (q *AtQueue) logger(j AtJob) *zap.Logger {
+	return q.sm.L().With(
+		zap.String("source", AtSource),
+		zap.String("id", j.ID),
+		zap.String("user", j.User),
+		zap.String("command", j.Command),
+		zap.String("stdin", j.Stdin),
+	)
+}
+
+func (q *AtQueue) save(j AtJob) error {
+	raw, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(q.Dir, 0700); err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it, to avoid to break the file when Concron stopped while writing.
+	tmp := q.path(j.ID) + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path(j.ID))
+}
+
+// schedule registers a job to the scheduler.
+// If the time of the job has already passed, it runs the job immediately.
+func (q *AtQueue) schedule(j AtJob) error {
+	if err := j.Validate(); err != nil {
+		return err
+	}
+
+	t, err := j.Task(q.env)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidJob, err)
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	q.entries[j.ID] = &atEntry{
+		Job:   j,
+		Task:  t,
+		Entry: q.scheduler.RegisterFunc(t.Schedule, func() { q.run(j.ID) }),
+	}
+	atJobGauge.Set(float64(len(q.entries)))
+
+	if !j.At.After(time.Now()) {
+		go q.run(j.ID)
+	}
+
+	return nil
+}
+
+// run runs a job, and removes it from the queue after finished.
+func (q *AtQueue) run(id string) {
+	q.Lock()
+	e, ok := q.entries[id]
+	if !ok || e.Running {
+		q.Unlock()
+		return
+	}
+	e.Running = true
+	q.Unlock()
+
+	q.scheduler.RunTask(e.Task)
+
+	if q.scheduler.accepting.Err() != nil {
+		// The job may not be executed because Concron is terminating.
+		// Keep it in the spool to run it after restart.
+		return
+	}
+
+	if err := q.remove(id); err != nil {
+		q.logger(e.Job).Error("failed to remove job", zap.String("path", q.path(id)), zap.Error(err))
+	}
+}
+
+func (q *AtQueue) remove(id string) error {
+	q.Lock()
+	q.forget(id)
+	q.Unlock()
+
+	return q.removeFile(id)
+}
+
+// forget removes the job from the queue and the scheduler, but keeps the spool file.
+// The caller must hold the lock.
+func (q *AtQueue) forget(id string) {
+	if e, ok := q.entries[id]; ok {
+		q.scheduler.Unregister(e.Entry)
+		delete(q.entries, id)
+	}
+	atJobGauge.Set(float64(len(q.entries)))
+}
+
+// removeFile removes the spool file of the job.
+func (q *AtQueue) removeFile(id string) error {
+	if err := os.Remove(q.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// authorized checks the bearer token of the request.
+func (q *AtQueue) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return q.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(q.token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	return json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, err error) error {
+	return writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// ServeHTTP implements http.Handler for the HTTP API.
+//
+//	GET    /api/jobs       lists jobs.
+//	POST   /api/jobs       submits a new job.
+//	GET    /api/jobs/{id}  shows a job.
+//	DELETE /api/jobs/{id}  cancels a job.
+func (q *AtQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/jobs"), "/")
+
+	switch {
+	case q.token == "":
+		err = writeJSONError(w, http.StatusForbidden, errors.New("API is disabled. Please set CONCRON_API_TOKEN"))
+	case !q.authorized(r):
+		w.Header().Set("WWW-Authenticate", `Bearer realm="concron"`)
+		err = writeJSONError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+	case id == "" && r.Method == "GET":
+		err = writeJSON(w, http.StatusOK, q.Jobs())
+	case id == "" && r.Method == "POST":
+		var j AtJob
+		if e := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJobSize)).Decode(&j); e != nil {
+			err = writeJSONError(w, http.StatusBadRequest, fmt.Errorf("%w: %s", ErrInvalidJob, e))
+			break
+		}
+		j, e := q.Submit(j)
+		switch {
+		case e == nil:
+			err = writeJSON(w, http.StatusCreated, j)
+		case errors.Is(e, ErrInvalidJob):
+			err = writeJSONError(w, http.StatusBadRequest, e)
+		default:
+			err = writeJSONError(w, http.StatusInternalServerError, e)
+		}
+	case id != "" && r.Method == "GET":
+		for _, j := range q.Jobs() {
+			if j.ID == id {
+				err = writeJSON(w, http.StatusOK, j)
+				return
+			}
+		}
+		err = writeJSONError(w, http.StatusNotFound, fmt.Errorf("%w: %s", ErrJobNotFound, id))
+	case id != "" && r.Method == "DELETE":
+		e := q.Cancel(id)
+		switch {
+		case e == nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errors.Is(e, ErrJobNotFound):
+			err = writeJSONError(w, http.StatusNotFound, e)
+		case errors.Is(e, ErrJobRunning):
+			err = writeJSONError(w, http.StatusConflict, e)
+		default:
+			err = writeJSONError(w, http.StatusInternalServerError, e)
+		}
+	default:
+		err = writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+
+	if err != nil {
+		q.sm.L().Error(
+			"failed to write response",
+			zap.Error(err),
+			zap.String("method", r.Method),
+			zap.String("url", r.URL.String()),
+		)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAtSchedule(t *testing.T) {
+	at := time.Date(2022, 1, 2, 18, 30, 0, 0, time.UTC)
+	s := AtSchedule{At: at}
+
+	if next := s.Next(at.Add(-time.Hour)); !next.Equal(at) {
+		t.Errorf("expected %s but got %s", at, next)
+	}
+	if next := s.Next(at); !next.IsZero() {
+		t.Errorf("expected zero but got %s", next)
+	}
+}
+
+func TestAtJob_Task(t *testing.T) {
+	j := AtJob{
+		ID:      "0123456789abcdef",
+		At:      time.Now(),
+		Command: "echo hello",
+		Env:     map[string]string{"TIMEOUT": "1m", "FOO": "bar"},
+	}
+
+	task, err := j.Task(Environ{"FOO=base", "CATCH_UP=yes"})
+	if err != nil {
+		t.Fatalf("failed to make task: %s", err)
+	}
+	if task.Source != AtSource || task.User != "*" || task.Timeout != time.Minute || task.CatchUp {
+		t.Errorf("unexpected task: %#v", task)
+	}
+	if v := task.Env.Get("FOO", ""); v != "bar" {
+		t.Errorf("unexpected FOO: %q", v)
+	}
+
+	for _, env := range []map[string]string{{"TIMEOUT": "soon"}, {"AFTER": "x"}} {
+		j.Env = env
+		if _, err := j.Task(nil); err == nil {
+			t.Errorf("%v: expected error", env)
+		}
+	}
+}
+
+func TestAtQueue(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test uses sh syntax")
+	}
+
+	dir := t.TempDir()
+	spool := filepath.Join(dir, "at")
+	out := filepath.Join(dir, "out")
+
+	sm := NewStatusMonitor(NewTestLogger(t))
+	s := NewScheduler(context.Background(), sm, nil)
+	go s.Run()
+	defer s.Shutdown(0)
+
+	q, err := OpenAtQueue(spool, "", Environ{}, s, sm)
+	if err != nil {
+		t.Fatalf("failed to open queue: %s", err)
+	}
+
+	later, err := q.Submit(AtJob{At: time.Now().Add(time.Hour), Command: "printf later >> " + out})
+	if err != nil {
+		t.Fatalf("failed to submit job: %s", err)
+	}
+	soon, err := q.Submit(AtJob{At: time.Now().Add(100 * time.Millisecond), Command: "printf soon >> " + out})
+	if err != nil {
+		t.Fatalf("failed to submit job: %s", err)
+	}
+
+	if js := q.Jobs(); len(js) != 2 || js[0].ID != soon.ID || js[1].ID != later.ID {
+		t.Fatalf("unexpected jobs: %v", js)
+	}
+	if _, err := os.Stat(filepath.Join(spool, soon.ID+".json")); err != nil {
+		t.Fatalf("job is not stored: %s", err)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	if bs, _ := os.ReadFile(out); string(bs) != "soon" {
+		t.Errorf("unexpected output: %q", string(bs))
+	}
+	if js := q.Jobs(); len(js) != 1 || js[0].ID != later.ID {
+		t.Errorf("unexpected jobs after run: %v", js)
+	}
+	if _, err := os.Stat(filepath.Join(spool, soon.ID+".json")); !os.IsNotExist(err) {
+		t.Errorf("job is not removed after run: %v", err)
+	}
+
+	// The job should be restored, and the missed job should run immediately.
+	missed := AtJob{ID: "0123456789abcdef", At: time.Now().Add(-time.Minute), Command: "printf missed >> " + out}
+	if err := q.save(missed); err != nil {
+		t.Fatalf("failed to save job: %s", err)
+	}
+
+	q2, err := OpenAtQueue(spool, "", Environ{}, s, sm)
+	if err != nil {
+		t.Fatalf("failed to open queue: %s", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if bs, _ := os.ReadFile(out); string(bs) != "soonmissed" {
+		t.Errorf("unexpected output: %q", string(bs))
+	}
+	if js := q2.Jobs(); len(js) != 1 || js[0].ID != later.ID {
+		t.Errorf("unexpected jobs after restore: %v", js)
+	}
+
+	if err := q2.Cancel(later.ID); err != nil {
+		t.Errorf("failed to cancel job: %s", err)
+	}
+	if err := q2.Cancel(later.ID); err == nil {
+		t.Errorf("expected error to cancel canceled job")
+	}
+	if js := q2.Jobs(); len(js) != 0 {
+		t.Errorf("unexpected jobs after cancel: %v", js)
+	}
+	if fs, _ := filepath.Glob(filepath.Join(spool, "*")); len(fs) != 0 {
+		t.Errorf("unexpected files in spool: %v", fs)
+	}
+}
+
+func TestAtQueue_Cancel(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+
+	sm := NewStatusMonitor(NewTestLogger(t))
+	s := NewScheduler(context.Background(), sm, nil)
+	defer s.Shutdown(0)
+
+	q, err := OpenAtQueue(filepath.Join(dir, "at"), "", Environ{}, s, sm)
+	if err != nil {
+		t.Fatalf("failed to open queue: %s", err)
+	}
+
+	running, err := q.Submit(AtJob{At: time.Now().Add(time.Hour), Command: "printf running >> " + out})
+	if err != nil {
+		t.Fatalf("failed to submit job: %s", err)
+	}
+	q.Lock()
+	q.entries[running.ID].Running = true
+	q.Unlock()
+
+	if err := q.Cancel(running.ID); !errors.Is(err, ErrJobRunning) {
+		t.Errorf("expected ErrJobRunning but got %v", err)
+	}
+	if js := q.Jobs(); len(js) != 1 {
+		t.Errorf("running job is removed: %v", js)
+	}
+
+	canceled, err := q.Submit(AtJob{At: time.Now().Add(time.Hour), Command: "printf canceled >> " + out})
+	if err != nil {
+		t.Fatalf("failed to submit job: %s", err)
+	}
+	if err := q.Cancel(canceled.ID); err != nil {
+		t.Fatalf("failed to cancel job: %s", err)
+	}
+
+	// The canceled job should not run even if the cron fires it just after canceling.
+	q.run(canceled.ID)
+	if bs, _ := os.ReadFile(out); len(bs) != 0 {
+		t.Errorf("canceled job executed: %q", string(bs))
+	}
+}
+
+func TestAtQueue_ServeHTTP(t *testing.T) {
+	sm := NewStatusMonitor(NewTestLogger(t))
+	s := NewScheduler(context.Background(), sm, nil)
+	defer s.Shutdown(0)
+
+	q, err := OpenAtQueue(filepath.Join(t.TempDir(), "at"), "secret", Environ{}, s, sm)
+	if err != nil {
+		t.Fatalf("failed to open queue: %s", err)
+	}
+	sm.SetAtQueue(q)
+
+	request := func(method, path, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		sm.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := request("GET", "/api/jobs", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status without token: %d", w.Code)
+	}
+	if w := request("GET", "/api/jobs", "wrong", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status with wrong token: %d", w.Code)
+	}
+
+	if w := request("POST", "/api/jobs", "secret", `{"command": "echo hello"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status for job without time: %d", w.Code)
+	}
+	if w := request("POST", "/api/jobs", "secret", `{`); w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status for broken job: %d", w.Code)
+	}
+
+	w := request("POST", "/api/jobs", "secret", `{"at": "2999-01-02T18:30:00Z", "command": "echo hello", "stdin": "world"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("unexpected status to submit: %d: %s", w.Code, w.Body)
+	}
+	var j AtJob
+	if err := json.Unmarshal(w.Body.Bytes(), &j); err != nil {
+		t.Fatalf("failed to parse response: %s", err)
+	}
+	if j.ID == "" || j.Command != "echo hello" || j.Stdin != "world" {
+		t.Errorf("unexpected job: %#v", j)
+	}
+
+	w = request("GET", "/api/jobs", "secret", "")
+	var js []AtJob
+	if err := json.Unmarshal(w.Body.Bytes(), &js); err != nil {
+		t.Fatalf("failed to parse response: %s", err)
+	}
+	if len(js) != 1 || js[0].ID != j.ID {
+		t.Errorf("unexpected jobs: %v", js)
+	}
+
+	if w := request("GET", "/", "", ""); !strings.Contains(w.Body.String(), j.ID) {
+		t.Errorf("job is not shown on the dashboard")
+	}
+
+	if w := request("GET", "/api/jobs/"+j.ID, "secret", ""); w.Code != http.StatusOK {
+		t.Errorf("unexpected status to get job: %d", w.Code)
+	}
+	if w := request("DELETE", "/api/jobs/"+j.ID, "secret", ""); w.Code != http.StatusNoContent {
+		t.Errorf("unexpected status to cancel: %d", w.Code)
+	}
+	if w := request("DELETE", "/api/jobs/"+j.ID, "secret", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unexpected status to cancel again: %d", w.Code)
+	}
+	if w := request("PUT", "/api/jobs", "secret", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status for PUT: %d", w.Code)
+	}
+
+	q.token = ""
+	if w := request("GET", "/api/jobs", "", ""); w.Code != http.StatusForbidden {
+		t.Errorf("unexpected status when API is disabled: %d", w.Code)
+	}
+}
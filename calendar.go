@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidCalendar = errors.New("invalid calendar")
+)
+
+// maxBlackoutSkips is how many blackouts Task.Next skips at most.
+const maxBlackoutSkips = 1000
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Calendar is a set of blackout windows that tasks should not run in.
+type Calendar struct {
+	Path   string
+	Ranges []TimeRange
+	Weekly []WeeklyWindow
+}
+
+// TimeRange is a blackout window from Start until End.
+type TimeRange struct {
+	Start time.Time
+	End   time.Time
+}
+
+// WeeklyWindow is a blackout window that repeats every week.
+//
+// Start and End are the time of day on the wall clock in Location.
+// If End is before Start, the window continues until End of the next day.
+// If Start and End are the same, the window is the whole day.
+type WeeklyWindow struct {
+	Days     [7]bool
+	Start    time.Duration
+	End      time.Duration
+	Location *time.Location
+}
+
+// LoadCalendar loads a calendar file for SKIP_CALENDAR.
+// The dates and times in the file are interpreted in loc.
+//
+// Each line of the file is one of the following formats.
+//
+//	2022-12-25                           # a whole day
+//	2022-12-24 - 2022-12-26              # days, including both ends
+//	2022-12-31 09:00-18:00               # a time range in a day
+//	2022-12-31 22:00 - 2023-01-01 06:00  # a time range
+//	Sat,Sun                              # whole days of every week
+//	Mon-Fri 09:00-18:00                  # a time range in days of every week
+//	* 12:00-13:00                        # a time range in every day
+func LoadCalendar(path string, loc *time.Location) (*Calendar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseCalendar(path, f, loc)
+}
+
+// ParseCalendar parses a calendar. See also LoadCalendar.
+func ParseCalendar(path string, r io.Reader, loc *time.Location) (*Calendar, error) {
+	c := &Calendar{Path: path}
+
+	s := bufio.NewScanner(r)
+	for i := 1; s.Scan(); i++ {
+		line := s.Text()
+		if idx := strings.IndexRune(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if err := c.parseLine(fields, loc); err != nil {
+			return nil, fmt.Errorf("%w: %s:%d: %q", ErrInvalidCalendar, path, i, strings.TrimSpace(line))
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Calendar) parseLine(fields []string, loc *time.Location) error {
+	if day, err := time.ParseInLocation("2006-01-02", fields[0], loc); err == nil {
+		switch {
+		case len(fields) == 1:
+			c.Ranges = append(c.Ranges, TimeRange{day, day.AddDate(0, 0, 1)})
+			return nil
+		case len(fields) == 2:
+			start, end, err := parseTimeWindow(fields[1])
+			if err != nil {
+				return err
+			}
+			r := TimeRange{addWallClock(day, start), addWallClock(day, end)}
+			if !r.End.After(r.Start) {
+				r.End = addWallClock(day.AddDate(0, 0, 1), end)
+			}
+			c.Ranges = append(c.Ranges, r)
+			return nil
+		case len(fields) == 3 && fields[1] == "-":
+			last, err := time.ParseInLocation("2006-01-02", fields[2], loc)
+			if err != nil || last.Before(day) {
+				return ErrInvalidCalendar
+			}
+			c.Ranges = append(c.Ranges, TimeRange{day, last.AddDate(0, 0, 1)})
+			return nil
+		case len(fields) == 5 && fields[2] == "-":
+			start, err := time.ParseInLocation("2006-01-02 15:04", fields[0]+" "+fields[1], loc)
+			if err != nil {
+				return err
+			}
+			end, err := time.ParseInLocation("2006-01-02 15:04", fields[3]+" "+fields[4], loc)
+			if err != nil || !end.After(start) {
+				return ErrInvalidCalendar
+			}
+			c.Ranges = append(c.Ranges, TimeRange{start, end})
+			return nil
+		default:
+			return ErrInvalidCalendar
+		}
+	}
+
+	days, err := parseWeekdays(fields[0])
+	if err != nil {
+		return err
+	}
+	w := WeeklyWindow{Days: days, Location: loc}
+
+	switch len(fields) {
+	case 1:
+	case 2:
+		w.Start, w.End, err = parseTimeWindow(fields[1])
+		if err != nil {
+			return err
+		}
+	default:
+		return ErrInvalidCalendar
+	}
+
+	c.Weekly = append(c.Weekly, w)
+	return nil
+}
+
+// parseWeekdays parses days of week like "*", "Mon", "Sat,Sun", or "Mon-Fri".
+func parseWeekdays(s string) (days [7]bool, err error) {
+	if s == "*" {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+
+	for _, x := range strings.Split(s, ",") {
+		xs := strings.SplitN(x, "-", 2)
+		first, ok := weekdayNames[strings.ToLower(xs[0])]
+		if !ok {
+			return days, ErrInvalidCalendar
+		}
+		last := first
+		if len(xs) == 2 {
+			last, ok = weekdayNames[strings.ToLower(xs[1])]
+			if !ok {
+				return days, ErrInvalidCalendar
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// parseTimeWindow parses a time range in a day like "09:00-18:00".
+func parseTimeWindow(s string) (start, end time.Duration, err error) {
+	xs := strings.SplitN(s, "-", 2)
+	if len(xs) != 2 {
+		return 0, 0, ErrInvalidCalendar
+	}
+	if start, err = parseTimeOfDay(xs[0]); err != nil {
+		return 0, 0, err
+	}
+	if end, err = parseTimeOfDay(xs[1]); err != nil {
+		return 0, 0, err
+	}
+	if start == end {
+		return 0, 0, ErrInvalidCalendar
+	}
+	return start, end, nil
+}
+
+// parseTimeOfDay parses a time of day like "09:00", and returns the duration since midnight.
+// It accepts "24:00" as the end of the day.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, ErrInvalidCalendar
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// addWallClock returns the time that the wall clock shows d after the midnight of the day.
+func addWallClock(day time.Time, d time.Duration) time.Time {
+	y, m, dd := day.Date()
+	return time.Date(y, m, dd, int(d/time.Hour), int(d%time.Hour/time.Minute), 0, 0, day.Location())
+}
+
+// Blackout checks if t is in a blackout window.
+// If it is, the second result is the end of the window.
+func (c *Calendar) Blackout(t time.Time) (end time.Time, ok bool) {
+	if c == nil {
+		return time.Time{}, false
+	}
+
+	for _, r := range c.Ranges {
+		if !t.Before(r.Start) && t.Before(r.End) && r.End.After(end) {
+			end, ok = r.End, true
+		}
+	}
+	for _, w := range c.Weekly {
+		if e, found := w.blackout(t); found && e.After(end) {
+			end, ok = e, true
+		}
+	}
+
+	return end, ok
+}
+
+func (w WeeklyWindow) blackout(t time.Time) (end time.Time, ok bool) {
+	lt := t.In(w.Location)
+	today := time.Date(lt.Year(), lt.Month(), lt.Day(), 0, 0, 0, 0, w.Location)
+	tod := time.Duration(lt.Hour())*time.Hour + time.Duration(lt.Minute())*time.Minute + time.Duration(lt.Second())*time.Second + time.Duration(lt.Nanosecond())
+
+	if w.Start == w.End {
+		// Whole day.
+		if w.Days[lt.Weekday()] {
+			return today.AddDate(0, 0, 1), true
+		}
+		return time.Time{}, false
+	}
+
+	if w.Start < w.End {
+		if w.Days[lt.Weekday()] && w.Start <= tod && tod < w.End {
+			return addWallClock(today, w.End), true
+		}
+		return time.Time{}, false
+	}
+
+	// The window continues until the next day.
+	if w.Days[lt.Weekday()] && w.Start <= tod {
+		return addWallClock(today.AddDate(0, 0, 1), w.End), true
+	}
+	if w.Days[(lt.Weekday()+6)%7] && tod < w.End {
+		return addWallClock(today, w.End), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalendar_Blackout(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatalf("failed to load timezone: %s", err)
+	}
+
+	c, err := ParseCalendar("test", strings.NewReader(strings.Join([]string{
+		"# holidays",
+		"2022-01-01",
+		"2022-04-29 - 2022-05-05",
+		"",
+		"2022-02-01 01:00-03:00  # maintenance",
+		"2022-02-10 22:00-02:00",
+		"2022-03-01 20:00 - 2022-03-03 08:00",
+		"Sat,Sun",
+		"mon-fri 12:00-13:00",
+		"* 23:30-24:00",
+		"Wed 23:00-01:00",
+	}, "\n")), tokyo)
+	if err != nil {
+		t.Fatalf("failed to parse calendar: %s", err)
+	}
+
+	tests := []struct {
+		Time string
+		End  string
+	}{
+		{"2021-12-31T22:00:00+09:00", ""},
+		{"2021-12-31T23:45:00+09:00", "2022-01-01T00:00:00+09:00"},
+		{"2022-01-01T00:00:00+09:00", "2022-01-02T00:00:00+09:00"}, // Saturday
+		{"2022-01-03T10:00:00+09:00", ""},
+		{"2022-01-03T12:00:00+09:00", "2022-01-03T13:00:00+09:00"},
+		{"2022-01-03T13:00:00+09:00", ""},
+		{"2022-01-03T03:00:00Z", "2022-01-03T13:00:00+09:00"},
+		{"2022-02-01T00:59:59+09:00", ""},
+		{"2022-02-01T02:00:00+09:00", "2022-02-01T03:00:00+09:00"},
+		{"2022-02-11T01:00:00+09:00", "2022-02-11T02:00:00+09:00"},
+		{"2022-03-02T12:00:00+09:00", "2022-03-03T08:00:00+09:00"},
+		{"2022-03-03T08:00:00+09:00", ""},
+		{"2022-05-03T09:00:00+09:00", "2022-05-06T00:00:00+09:00"},
+		{"2022-05-06T09:00:00+09:00", ""},
+		{"2022-01-05T23:10:00+09:00", "2022-01-06T01:00:00+09:00"}, // Wednesday
+		{"2022-01-05T23:45:00+09:00", "2022-01-06T01:00:00+09:00"},
+		{"2022-01-06T00:30:00+09:00", "2022-01-06T01:00:00+09:00"},
+		{"2022-01-07T00:30:00+09:00", ""},
+	}
+
+	for _, tt := range tests {
+		ts, _ := time.Parse(time.RFC3339, tt.Time)
+		end, ok := c.Blackout(ts)
+		if tt.End == "" {
+			if ok {
+				t.Errorf("%s: expected not blackout but until %s", tt.Time, end)
+			}
+			continue
+		}
+		expected, _ := time.Parse(time.RFC3339, tt.End)
+		if !ok || !end.Equal(expected) {
+			t.Errorf("%s: expected until %s but got %s (%v)", tt.Time, expected, end, ok)
+		}
+	}
+
+	var nilCalendar *Calendar
+	if _, ok := nilCalendar.Blackout(time.Now()); ok {
+		t.Errorf("nil calendar reports blackout")
+	}
+}
+
+func TestParseCalendar_invalid(t *testing.T) {
+	tests := []string{
+		"2022-13-01",
+		"2022-01-02 - 2022-01-01",
+		"2022-01-01 -",
+		"2022-01-01 09:00",
+		"2022-01-01 09:00-09:00",
+		"2022-01-01 25:00-26:00",
+		"2022-01-02 09:00 - 2022-01-01 09:00",
+		"someday",
+		"Mon-Funday",
+		"Mon 9-18",
+		"Mon 09:00-18:00 extra",
+	}
+
+	for _, tt := range tests {
+		_, err := ParseCalendar("test", strings.NewReader("# comment\n"+tt), time.UTC)
+		if !errors.Is(err, ErrInvalidCalendar) {
+			t.Errorf("%q: unexpected error: %v", tt, err)
+		} else if !strings.Contains(err.Error(), "test:2:") {
+			t.Errorf("%q: error does not include line number: %s", tt, err)
+		}
+	}
+}
+
+func TestTask_Next_calendar(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calendar")
+	if err := os.WriteFile(path, []byte("Sat,Sun\n2022-01-03\nMon-Fri 00:00-08:00\n"), 0644); err != nil {
+		t.Fatalf("failed to write calendar: %s", err)
+	}
+
+	task, err := ParseTask("test", "0 * * * * echo hello", Environ{"TZ=UTC", "SKIP_CALENDAR=" + path})
+	if err != nil {
+		t.Fatalf("failed to parse task: %s", err)
+	}
+	if task.Calendar == nil || task.Calendar.Path != path {
+		t.Fatalf("calendar is not loaded: %v", task.Calendar)
+	}
+
+	// 2022-01-01 is Saturday.
+	next := task.Next(time.Date(2021, 12, 31, 23, 30, 0, 0, time.UTC))
+	if expected := time.Date(2022, 1, 4, 8, 0, 0, 0, time.UTC); !next.Equal(expected) {
+		t.Errorf("expected %s but got %s", expected, next)
+	}
+
+	if _, err := ParseTask("test", "0 * * * * echo hello", Environ{"SKIP_CALENDAR=" + path + ".missing"}); err == nil {
+		t.Errorf("expected error for missing calendar")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// CgroupLimits is limits for the cgroup of a task.
+type CgroupLimits struct {
+	// MemoryMax is the maximum memory usage in bytes. 0 means no limit.
+	MemoryMax uint64
+
+	// CPUMax is the maximum number of CPUs to use, like 0.5 or 2. 0 means no limit.
+	CPUMax float64
+}
+
+// ParseCgroupLimits reads MEMORY_MAX and CPU_MAX from the Environ.
+//
+// MEMORY_MAX accepts size like 512MiB or 1G.
+// CPU_MAX accepts number of CPUs like 0.5, or percentage of a CPU like 50%.
+func ParseCgroupLimits(env Environ) (CgroupLimits, error) {
+	var l CgroupLimits
+
+	if v := env.Get("MEMORY_MAX", ""); v != "" {
+		n, err := humanize.ParseBytes(v)
+		if err != nil || n == 0 {
+			return CgroupLimits{}, fmt.Errorf("MEMORY_MAX: invalid size: %q", v)
+		}
+		l.MemoryMax = n
+	}
+
+	if v := env.Get("CPU_MAX", ""); v != "" {
+		var f float64
+		var err error
+		if strings.HasSuffix(v, "%") {
+			f, err = strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+			f /= 100
+		} else {
+			f, err = strconv.ParseFloat(v, 64)
+		}
+		if err != nil || f <= 0 {
+			return CgroupLimits{}, fmt.Errorf("CPU_MAX: invalid number of CPUs: %q", v)
+		}
+		l.CPUMax = f
+	}
+
+	return l, nil
+}
+
+// ResourceUsage is the resource usage of a task run, measured by cgroup.
+type ResourceUsage struct {
+	MemoryPeak uint64
+	CPUTime    time.Duration
+	OOMKills   int
+}
@@ -0,0 +1,211 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// cpuMaxPeriod is the period for cpu.max in microseconds.
+const cpuMaxPeriod = 100000
+
+var cgroupSeq uint64
+
+// Cgroup is a cgroup v2 for a single run of a task.
+// A nil Cgroup means that the task runs without cgroup.
+type Cgroup struct {
+	Path string
+
+	ready, wait *os.File
+}
+
+// StartCgroup makes a new cgroup for a run of the task under CONCRON_CGROUP, and makes exec.Cmd to start in it.
+// It returns nil if CONCRON_CGROUP is not set.
+//
+// The command waits in the exec helper until Place is called, so all processes of the task are always in the cgroup.
+func StartCgroup(l LoggerHolder, cmd *exec.Cmd, t Task) (*Cgroup, error) {
+	root := t.cgroupRoot
+	if root == "" {
+		if t.Cgroup != (CgroupLimits{}) {
+			l.L().Warn("MEMORY_MAX and CPU_MAX are ignored because CONCRON_CGROUP is not set")
+		}
+		return nil, nil
+	}
+
+	// The controllers may be already enabled, or may not be allowed to enable. Setting limits will fail in the latter case.
+	if err := os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte("+memory +cpu"), 0644); err != nil {
+		l.L().Debug("failed to enable cgroup controllers", zap.String("cgroup", root), zap.Error(err))
+	}
+
+	c := &Cgroup{
+		Path: filepath.Join(root, fmt.Sprintf("%016x-%d", t.ID, atomic.AddUint64(&cgroupSeq, 1))),
+	}
+	if err := os.Mkdir(c.Path, 0755); err != nil {
+		return nil, err
+	}
+
+	if t.Cgroup.MemoryMax > 0 {
+		if err := c.write("memory.max", strconv.FormatUint(t.Cgroup.MemoryMax, 10)); err != nil {
+			c.remove()
+			return nil, fmt.Errorf("failed to set MEMORY_MAX: %w", err)
+		}
+		// Kill the whole task when OOM, instead of a part of it.
+		if err := c.write("memory.oom.group", "1"); err != nil {
+			l.L().Debug("failed to set memory.oom.group", zap.String("cgroup", c.Path), zap.Error(err))
+		}
+	}
+
+	if t.Cgroup.CPUMax > 0 {
+		quota := int(t.Cgroup.CPUMax * cpuMaxPeriod)
+		if err := c.write("cpu.max", fmt.Sprintf("%d %d", quota, cpuMaxPeriod)); err != nil {
+			c.remove()
+			return nil, fmt.Errorf("failed to set CPU_MAX: %w", err)
+		}
+	}
+
+	var err error
+	c.wait, c.ready, err = os.Pipe()
+	if err != nil {
+		c.remove()
+		return nil, err
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, c.wait)
+	fd := 2 + len(cmd.ExtraFiles)
+
+	if err := useExecHelper(cmd, "-wait-fd", strconv.Itoa(fd)); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Place moves the started process into the cgroup, and lets it continue.
+func (c *Cgroup) Place(pid int) error {
+	if c == nil {
+		return nil
+	}
+
+	c.wait.Close()
+	defer c.ready.Close()
+
+	if err := c.write("cgroup.procs", strconv.Itoa(pid)); err != nil {
+		return err
+	}
+
+	if _, err := c.ready.Write([]byte{0}); err != nil {
+		return err
+	}
+
+	// Processes that the command left behind would keep the output pipes open, and make exec.Cmd.Wait block.
+	// So kill them as soon as the command exits. WNOWAIT leaves the exit status for exec.Cmd.Wait.
+	go func() {
+		var info unix.Siginfo
+		unix.Waitid(unix.P_PID, pid, &info, unix.WEXITED|unix.WNOWAIT, nil)
+		c.kill()
+	}()
+
+	return nil
+}
+
+// Close kills all processes remaining in the cgroup, and removes the cgroup.
+// It returns the resource usage of the processes in the cgroup.
+func (c *Cgroup) Close() (*ResourceUsage, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	c.wait.Close()
+	c.ready.Close()
+
+	c.kill()
+
+	var u ResourceUsage
+	if s, err := c.read("memory.peak"); err == nil {
+		u.MemoryPeak, _ = strconv.ParseUint(s, 10, 64)
+	}
+	if usec, ok := c.readKey("cpu.stat", "usage_usec"); ok {
+		u.CPUTime = time.Duration(usec) * time.Microsecond
+	}
+	if n, ok := c.readKey("memory.events", "oom_kill"); ok {
+		u.OOMKills = int(n)
+	}
+
+	return &u, c.remove()
+}
+
+// kill kills all processes in the cgroup and waits for them to exit.
+func (c *Cgroup) kill() {
+	// cgroup.kill is available since Linux 5.14.
+	useKillFile := c.write("cgroup.kill", "1") == nil
+
+	for i := 0; i < 100; i++ {
+		s, err := c.read("cgroup.procs")
+		if err != nil || s == "" {
+			return
+		}
+		if !useKillFile {
+			for _, p := range strings.Fields(s) {
+				if pid, err := strconv.Atoi(p); err == nil {
+					syscall.Kill(pid, syscall.SIGKILL)
+				}
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// remove removes the cgroup directory.
+// It retries for a while because the cgroup can not be removed until the killed processes are reaped.
+func (c *Cgroup) remove() (err error) {
+	for i := 0; i < 100; i++ {
+		err = os.Remove(c.Path)
+		if err == nil || !errors.Is(err, syscall.EBUSY) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
+
+func (c *Cgroup) write(name, value string) error {
+	return os.WriteFile(filepath.Join(c.Path, name), []byte(value), 0644)
+}
+
+func (c *Cgroup) read(name string) (string, error) {
+	b, err := os.ReadFile(filepath.Join(c.Path, name))
+	return strings.TrimSpace(string(b)), err
+}
+
+// readKey reads a value from the flat keyed file like cpu.stat.
+func (c *Cgroup) readKey(name, key string) (uint64, bool) {
+	f, err := os.Open(filepath.Join(c.Path, name))
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		xs := strings.Fields(s.Text())
+		if len(xs) == 2 && xs[0] == key {
+			n, err := strconv.ParseUint(xs[1], 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// This test requires a writable cgroup v2 directory in CONCRON_TEST_CGROUP.
+func TestTask_Run_cgroup(t *testing.T) {
+	root := os.Getenv("CONCRON_TEST_CGROUP")
+	if root == "" {
+		t.Skip("CONCRON_TEST_CGROUP is not set")
+	}
+
+	task, err := ParseTask("test", "@daily sleep 60 & cat /proc/self/cgroup", Environ{})
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	task.cgroupRoot = root
+
+	r := &TestTaskReporter{Logger: zap.NewNop()}
+	if err := task.Run(context.Background(), r); err != nil {
+		t.Fatalf("failed to run: %s\n%s", err, r.Output.String())
+	}
+
+	if id := fmt.Sprintf("/%016x-", task.ID); !strings.Contains(r.Output.String(), id) {
+		t.Errorf("the task is not in the cgroup: %q", r.Output.String())
+	}
+
+	if r.Usage == nil {
+		t.Fatalf("resource usage is not reported")
+	}
+
+	cgroups, err := filepath.Glob(filepath.Join(root, "*-*"))
+	if err != nil {
+		t.Fatalf("failed to list cgroups: %s", err)
+	}
+	if len(cgroups) != 0 {
+		t.Errorf("cgroups are not removed: %v", cgroups)
+	}
+}
+
+func TestTask_Run_cgroupFromEnv(t *testing.T) {
+	root := t.TempDir()
+
+	task, err := ParseTask("test", "@daily echo hello", Environ{"CONCRON_CGROUP=" + root})
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+
+	r := &TestTaskReporter{Logger: zap.NewNop()}
+	if err := task.Run(context.Background(), r); err != nil {
+		t.Fatalf("failed to run: %s\n%s", err, r.Output.String())
+	}
+
+	if fs, _ := os.ReadDir(root); len(fs) != 0 {
+		t.Errorf("CONCRON_CGROUP in the task env is used: %v", fs)
+	}
+}
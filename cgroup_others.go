@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os/exec"
+	"runtime"
+)
+
+// Cgroup is a cgroup for a single run of a task.
+// It is not supported except Linux, so it is always nil.
+type Cgroup struct{}
+
+// StartCgroup makes a new cgroup for a run of the task.
+// Cgroup is supported only in Linux, so this function only shows a warning.
+func StartCgroup(l LoggerHolder, _ *exec.Cmd, t Task) (*Cgroup, error) {
+	if t.cgroupRoot != "" || t.Cgroup != (CgroupLimits{}) {
+		l.L().Warn("cgroup is not supported in " + runtime.GOOS)
+	}
+	return nil, nil
+}
+
+// Place moves the started process into the cgroup.
+func (c *Cgroup) Place(pid int) error {
+	return nil
+}
+
+// Close removes the cgroup.
+func (c *Cgroup) Close() (*ResourceUsage, error) {
+	return nil, nil
+}
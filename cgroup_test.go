@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCgroupLimits(t *testing.T) {
+	tests := []struct {
+		Env    Environ
+		Limits CgroupLimits
+		Error  bool
+	}{
+		{Environ{}, CgroupLimits{}, false},
+		{Environ{"MEMORY_MAX=256MiB"}, CgroupLimits{MemoryMax: 256 * 1024 * 1024}, false},
+		{Environ{"CPU_MAX=0.5"}, CgroupLimits{CPUMax: 0.5}, false},
+		{Environ{"CPU_MAX=150%"}, CgroupLimits{CPUMax: 1.5}, false},
+		{Environ{"MEMORY_MAX=1G", "CPU_MAX=2"}, CgroupLimits{MemoryMax: 1000 * 1000 * 1000, CPUMax: 2}, false},
+		{Environ{"MEMORY_MAX=lots"}, CgroupLimits{}, true},
+		{Environ{"CPU_MAX=0"}, CgroupLimits{}, true},
+		{Environ{"CPU_MAX=-50%"}, CgroupLimits{}, true},
+		{Environ{"CPU_MAX=half"}, CgroupLimits{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.Env, " "), func(t *testing.T) {
+			l, err := ParseCgroupLimits(tt.Env)
+			if tt.Error {
+				if err == nil {
+					t.Fatalf("expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+
+			if l != tt.Limits {
+				t.Errorf("unexpected limits\nexpected: %v\n but got: %v", tt.Limits, l)
+			}
+		})
+	}
+}
+
+func TestTaskWithStatus_UsageStr(t *testing.T) {
+	tests := []struct {
+		Usage  *ResourceUsage
+		Output string
+	}{
+		{nil, ""},
+		{&ResourceUsage{CPUTime: 1500 * time.Millisecond}, "CPU time 1.5s"},
+		{&ResourceUsage{MemoryPeak: 12 * 1024 * 1024, CPUTime: time.Second}, "memory peak 12 MiB, CPU time 1s"},
+		{&ResourceUsage{MemoryPeak: 1024, CPUTime: time.Second, OOMKills: 2}, "memory peak 1.0 KiB, CPU time 1s, 2 processes killed by OOM killer"},
+	}
+
+	for _, tt := range tests {
+		ts := TaskWithStatus{TaskStatus: TaskStatus{Usage: tt.Usage}}
+		if s := ts.UsageStr(); s != tt.Output {
+			t.Errorf("expected %q but got %q", tt.Output, s)
+		}
+	}
+}
@@ -2,15 +2,37 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+
+	"github.com/google/shlex"
+)
+
+var (
+	ErrDuplicatedName      = errors.New("duplicated task name")
+	ErrUnknownTask         = errors.New("unknown task name")
+	ErrDependencyCycle     = errors.New("dependency cycle")
+	ErrConflictingLimit    = errors.New("conflicting CONCURRENCY_LIMIT in the same group")
+	ErrIncludeLoop         = errors.New("include loop")
+	ErrTaskInInclude       = errors.New("included file can not have tasks")
+	ErrUnterminatedHeredoc = errors.New("unterminated heredoc")
+	ErrInvalidOption       = errors.New("invalid option comment")
+	ErrUnknownOption       = errors.New("unknown option")
+	ErrOrphanOption        = errors.New("option comment must be followed by a task")
 )
 
 // Crontab is a set of Task.
 type Crontab struct {
 	Path  string
 	Tasks []Task
+
+	// IncludedFiles is the paths of files that included by @include lines.
+	IncludedFiles []string
 }
 
 // Has checks the Crontab contains the specified Task.
@@ -23,38 +45,351 @@ func (c Crontab) Has(t Task) bool {
 	return false
 }
 
-func (c *Crontab) add(t Task) {
+// Includes checks the Crontab included the file.
+func (c Crontab) Includes(path string) bool {
+	for _, x := range c.IncludedFiles {
+		if x == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Crontab) add(t Task) bool {
 	if !c.Has(t) {
 		c.Tasks = append(c.Tasks, t)
+		return true
+	}
+	return false
+}
+
+// Lookup finds a Task by name.
+func (c Crontab) Lookup(name string) (Task, bool) {
+	for _, t := range c.Tasks {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Task{}, false
+}
+
+// checkGroups checks that the tasks in the same ConcurrencyGroup don't declare different limits.
+// The lines is the line numbers of each task, to report where is wrong.
+func (c Crontab) checkGroups(lines []int) error {
+	limits := make(map[string]int)
+	for i, t := range c.Tasks {
+		if t.Group == "" || t.GroupLimit == 0 {
+			continue
+		}
+		if l, ok := limits[t.Group]; ok && l != t.GroupLimit {
+			return fmt.Errorf("%d: %w: %q has %d and %d", lines[i], ErrConflictingLimit, t.Group, l, t.GroupLimit)
+		}
+		limits[t.Group] = t.GroupLimit
+	}
+	return nil
+}
+
+// checkDependencies checks task names and dependencies between tasks.
+// The lines is the line numbers of each task, to report where is wrong.
+func (c Crontab) checkDependencies(lines []int) error {
+	names := make(map[string]int)
+	for i, t := range c.Tasks {
+		if t.Name == "" {
+			continue
+		}
+		if _, ok := names[t.Name]; ok {
+			return fmt.Errorf("%d: %w: %q", lines[i], ErrDuplicatedName, t.Name)
+		}
+		names[t.Name] = i
+	}
+
+	for i, t := range c.Tasks {
+		for _, up := range []string{t.After, t.AfterFailure} {
+			if _, ok := names[up]; up != "" && !ok {
+				return fmt.Errorf("%d: %w: %q", lines[i], ErrUnknownTask, up)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(c.Tasks))
+
+	var visit func(i int, path []string) error
+	visit = func(i int, path []string) error {
+		t := c.Tasks[i]
+		path = append(path, t.Name)
+
+		switch state[i] {
+		case visiting:
+			return fmt.Errorf("%d: %w: %s", lines[i], ErrDependencyCycle, strings.Join(path, " -> "))
+		case visited:
+			return nil
+		}
+
+		state[i] = visiting
+		for _, up := range []string{t.After, t.AfterFailure} {
+			if up == "" {
+				continue
+			}
+			if err := visit(names[up], path); err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+
+		return nil
+	}
+
+	for i := range c.Tasks {
+		if err := visit(i, nil); err != nil {
+			return err
+		}
 	}
+
+	return nil
+}
+
+// Dependencies returns dependencies between tasks in this Crontab.
+func (c Crontab) Dependencies() []Dependency {
+	var ds []Dependency
+	for _, t := range c.Tasks {
+		if t.After != "" {
+			ds = append(ds, Dependency{Upstream: t.After, Downstream: t.Name, Command: t.Command, OnFailure: false})
+		}
+		if t.AfterFailure != "" {
+			ds = append(ds, Dependency{Upstream: t.AfterFailure, Downstream: t.Name, Command: t.Command, OnFailure: true})
+		}
+	}
+	return ds
+}
+
+// Dependency is a dependency between two tasks.
+type Dependency struct {
+	Upstream   string
+	Downstream string
+	Command    string
+	OnFailure  bool
 }
 
 // ParseCrontab parses crontab file.
+// The relative paths in @include lines are resolved from the directory of the path.
 func ParseCrontab(path string, r io.Reader, env Environ) (Crontab, error) {
-	ct := Crontab{Path: path}
+	p := crontabParser{
+		crontab: Crontab{Path: path},
+		env:     env,
+	}
 
+	if err := p.parse(filepath.Clean(path), r, nil); err != nil {
+		return Crontab{}, err
+	}
+
+	if err := p.crontab.checkDependencies(p.lines); err != nil {
+		return Crontab{}, err
+	}
+
+	if err := p.crontab.checkGroups(p.lines); err != nil {
+		return Crontab{}, err
+	}
+
+	return p.crontab, nil
+}
+
+// ParseCrontabFile parses a crontab file in the format that detected by the extension of the path.
+// The files named *.yaml or *.yml are parsed by ParseYAMLCrontab, and the others are parsed by ParseCrontab.
+func ParseCrontabFile(path string, r io.Reader, env Environ) (Crontab, error) {
+	if IsYAMLCrontab(path) {
+		return ParseYAMLCrontab(path, r, env)
+	}
+	return ParseCrontab(path, r, env)
+}
+
+// crontabParser is the state of parsing a crontab file and its included files.
+type crontabParser struct {
+	crontab Crontab
+	env     Environ
+	secrets []string
+	lines   []int
+}
+
+// parse parses a crontab file.
+// The stack is the files that including this file. It is empty if the file is not included.
+func (p *crontabParser) parse(path string, r io.Reader, stack []string) error {
 	s := bufio.NewScanner(r)
 	ln := 0
+
+	// options are the options in the structured comments, that are applied to the next task only.
+	var options Environ
+	optionLine := 0
+
 	for s.Scan() {
 		ln++
+		start := ln
 
 		line := strings.TrimSpace(s.Text())
+		for isContinued(line) {
+			line = strings.TrimSpace(strings.TrimSuffix(line, "\\"))
+			if !s.Scan() {
+				break
+			}
+			ln++
+			line = strings.TrimSpace(line + " " + strings.TrimSpace(s.Text()))
+		}
+
 		switch DetectLineType(line) {
 		case EmptyLine:
 			continue
 		case TaskLine:
-			t, err := ParseTask(path, line, append(Environ{}, env...))
+			if len(stack) > 0 {
+				return fmt.Errorf("%d: %w", start, ErrTaskInInclude)
+			}
+			var delim, stdin string
+			if m := heredocPattern.FindStringSubmatchIndex(line); m != nil && line[m[4]:m[5]] == line[m[8]:m[9]] {
+				delim = line[m[6]:m[7]]
+				body, err := readHeredoc(s, &ln, delim, m[2] != m[3])
+				if err != nil {
+					return fmt.Errorf("%d: %w", start, err)
+				}
+				line, stdin = strings.TrimSpace(line[:m[2]-len("<<")]), body
+			}
+			env := append(Environ{}, p.env...)
+			for _, o := range options {
+				kv := strings.SplitN(o, "=", 2)
+				env.set(kv[0], kv[1])
+			}
+			options, optionLine = nil, 0
+			t, err := parseTask(p.crontab.Path, line, env, delim, stdin)
 			if err != nil {
-				return Crontab{}, fmt.Errorf("%d: %w", ln, err)
+				return fmt.Errorf("%d: %w", start, err)
+			}
+			t.SetSecrets(p.secrets)
+			if p.crontab.add(t) {
+				p.lines = append(p.lines, start)
 			}
-			ct.add(t)
 		case EnvLine:
-			env.Set(line)
+			mode, err := ParseExpandMode(p.env.Get("EXPAND_ENV", ""))
+			if err != nil {
+				return fmt.Errorf("%d: %w", start, err)
+			}
+			ss, err := p.env.SetExpand(line, mode)
+			if err != nil {
+				return fmt.Errorf("%d: %w", start, err)
+			}
+			p.secrets = append(p.secrets, ss...)
+
+			// Check EXPAND_ENV at its own line, because it may not be used by any following lines.
+			if k, _ := ParseEnv(line); k == "EXPAND_ENV" {
+				if _, err := ParseExpandMode(p.env.Get("EXPAND_ENV", "")); err != nil {
+					return fmt.Errorf("%d: %w", start, err)
+				}
+			}
+		case IncludeLine:
+			if err := p.include(path, line, stack); err != nil {
+				return fmt.Errorf("%d: %w", start, err)
+			}
+		case OptionLine:
+			opts, err := ParseOptionComment(line)
+			if err != nil {
+				return fmt.Errorf("%d: %w", start, err)
+			}
+			if optionLine == 0 {
+				optionLine = start
+			}
+			options = append(options, opts...)
 		case InvalidLine:
-			return Crontab{}, fmt.Errorf("%d: %w", ln, ErrInvalidLine)
+			return fmt.Errorf("%d: %w", start, ErrInvalidLine)
 		}
 	}
-	return ct, s.Err()
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if optionLine > 0 {
+		return fmt.Errorf("%d: %w", optionLine, ErrOrphanOption)
+	}
+	return nil
+}
+
+// isContinued reports whether the line continues to the next line, that is ends with a backslash after a space.
+// Only task lines can continue, so the values of environment variables can end with a backslash as before.
+func isContinued(line string) bool {
+	if DetectLineType(line) != TaskLine {
+		return false
+	}
+	return line == "\\" || strings.HasSuffix(line, " \\") || strings.HasSuffix(line, "\t\\")
+}
+
+// heredocPattern matches the heredoc marker like "<<EOF", "<<-EOF", or "<<'EOF'" at the end of the task line.
+// The "<<<" is not a heredoc but a here-string of the shell, so it is not matched.
+var heredocPattern = regexp.MustCompile(`(?:^|[^<])<<(-?)[ \t]*(['"]?)([A-Za-z_][A-Za-z0-9_]*)(['"]?)[ \t]*$`)
+
+// readHeredoc reads lines until the delimiter and returns them as the stdin.
+// If indented is true, the leading spaces of each line and the delimiter are removed like "<<-" of the shell.
+func readHeredoc(s *bufio.Scanner, ln *int, delim string, indented bool) (string, error) {
+	var body strings.Builder
+	for s.Scan() {
+		*ln++
+		line := strings.TrimSuffix(s.Text(), "\r")
+		if indented {
+			line = strings.TrimLeft(line, " \t")
+		}
+		if strings.TrimSpace(line) == delim {
+			return body.String(), nil
+		}
+		body.WriteString(line + "\n")
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnterminatedHeredoc, delim)
+}
+
+// include parses a file that specified by an @include line.
+func (p *crontabParser) include(from, line string, stack []string) error {
+	target := strings.TrimSpace(strings.TrimPrefix(line, "@include"))
+
+	mode, err := ParseExpandMode(p.env.Get("EXPAND_ENV", ""))
+	if err != nil {
+		return err
+	}
+	if mode != ExpandNone {
+		target, err = p.env.Expand(target, mode == ExpandStrict)
+		if err != nil {
+			return err
+		}
+	}
+
+	if target == "" {
+		return ErrInvalidLine
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(from), target)
+	}
+	target = filepath.Clean(target)
+
+	stack = append(stack, from)
+	for _, x := range stack {
+		if x == target {
+			return fmt.Errorf("%w: %s", ErrIncludeLoop, strings.Join(append(stack, target), " -> "))
+		}
+	}
+
+	f, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !p.crontab.Includes(target) {
+		p.crontab.IncludedFiles = append(p.crontab.IncludedFiles, target)
+	}
+
+	if err := p.parse(target, f, stack); err != nil {
+		return fmt.Errorf("%s: %w", target, err)
+	}
+	return nil
 }
 
 // LineType is a type of line in crontab file.
@@ -65,18 +400,114 @@ const (
 	TaskLine
 	EnvLine
 	EmptyLine
+	IncludeLine
+	OptionLine
 )
 
 // DetectLineType detects what kind of line is it in crontab file.
 func DetectLineType(s string) LineType {
 	switch {
+	case isOptionComment(s):
+		return OptionLine
 	case s == "" || s[0] == byte('#'):
 		return EmptyLine
+	case s == "@include" || strings.HasPrefix(s, "@include ") || strings.HasPrefix(s, "@include\t"):
+		return IncludeLine
 	case strings.ContainsRune("@*0123456789", rune(s[0])):
 		return TaskLine
+	case s[0] == byte('H') && (len(s) == 1 || strings.ContainsRune(" \t(/,", rune(s[1]))):
+		return TaskLine
 	case strings.ContainsRune(s, '='):
 		return EnvLine
 	default:
 		return InvalidLine
 	}
 }
+
+// optionCommentPrefix is the prefix of the structured comment for the task options, like "# concron: name=backup timeout=1h".
+const optionCommentPrefix = "concron:"
+
+// isOptionComment checks if the line is a structured comment for the task options.
+// It is when any word after the prefix is key=value, so a comment like "# concron: managed by ansible" is a normal comment.
+// The other words in the structured comment are reported as errors by ParseOptionComment.
+func isOptionComment(s string) bool {
+	if !strings.HasPrefix(s, "#") {
+		return false
+	}
+	s = strings.TrimSpace(s[1:])
+	if !strings.HasPrefix(s, optionCommentPrefix) {
+		return false
+	}
+	s = strings.TrimPrefix(s, optionCommentPrefix)
+
+	fields, err := shlex.Split(s)
+	if err != nil {
+		// Check the words roughly, to report a broken quote in the options as an error.
+		fields = strings.Fields(s)
+	}
+	for _, f := range fields {
+		if strings.IndexByte(f, '=') > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// optionKeys is the map from the keys in the structured comment to the environment variable names.
+var optionKeys = map[string]string{
+	"name":               "NAME",
+	"after":              "AFTER",
+	"after_failure":      "AFTER_FAILURE",
+	"timeout":            "TIMEOUT",
+	"kill_grace":         "KILL_GRACE",
+	"retries":            "RETRY_COUNT",
+	"retry_count":        "RETRY_COUNT",
+	"retry_delay":        "RETRY_DELAY",
+	"retry_backoff":      "RETRY_BACKOFF",
+	"random_delay":       "RANDOM_DELAY",
+	"catch_up":           "CATCH_UP",
+	"concurrency_policy": "CONCURRENCY_POLICY",
+	"concurrency_group":  "CONCURRENCY_GROUP",
+	"concurrency_limit":  "CONCURRENCY_LIMIT",
+	"dst_policy":         "DST_POLICY",
+	"skip_calendar":      "SKIP_CALENDAR",
+	"workdir":            "WORKDIR",
+	"nice":               "NICE",
+	"ionice_class":       "IONICE_CLASS",
+	"ionice_level":       "IONICE_LEVEL",
+	"memory_max":         "MEMORY_MAX",
+	"cpu_max":            "CPU_MAX",
+	"limit_as":           "LIMIT_AS",
+	"limit_cpu":          "LIMIT_CPU",
+	"limit_nofile":       "LIMIT_NOFILE",
+	"limit_nproc":        "LIMIT_NPROC",
+}
+
+// ParseOptionComment parses a structured comment like "# concron: name=backup timeout=1h retries=2".
+// The result is the options as environment variables, like "NAME=backup".
+// The values can be quoted like shell, for example name="daily backup".
+func ParseOptionComment(s string) (Environ, error) {
+	s = strings.TrimSpace(strings.TrimPrefix(s, "#"))
+	if !strings.HasPrefix(s, optionCommentPrefix) {
+		return nil, ErrInvalidOption
+	}
+
+	fields, err := shlex.Split(strings.TrimPrefix(s, optionCommentPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidOption, err)
+	}
+
+	var env Environ
+	for _, f := range fields {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidOption, f)
+		}
+		key, ok := optionKeys[strings.ToLower(kv[0])]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownOption, kv[0])
+		}
+		env.set(key, kv[1])
+	}
+	return env, nil
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDetectLineType(t *testing.T) {
@@ -16,11 +19,26 @@ func TestDetectLineType(t *testing.T) {
 	}{
 		{"", EmptyLine},
 		{"# this is comment", EmptyLine},
+		{"# concron: name=backup timeout=1h", OptionLine},
+		{"# concron is a cron", EmptyLine},
+		{"# concron: managed by ansible", EmptyLine},
+		{"# concron: don't edit", EmptyLine},
+		{"# concron: timeout", EmptyLine},
+		{"#concron:", EmptyLine},
+		{"# concron: name=daily backup", OptionLine},
+		{"# concron: timeout 1h name=x", OptionLine},
+		{"# concron: name='broken", OptionLine},
 		{"* * * * *\troot\techo hello world", TaskLine},
 		{"15 */2 * * *\techo hello world", TaskLine},
 		{"@hourly echo wah", TaskLine},
+		{"H H(0-5) * * *\techo hello", TaskLine},
+		{"H/15 * * * *\techo hello", TaskLine},
+		{"HOME=/root", EnvLine},
 		{"MAILTO=\"\"", EnvLine},
 		{"SHELL = /bin/sh", EnvLine},
+		{"@include common.env", IncludeLine},
+		{"@include\t/etc/concron/common.env", IncludeLine},
+		{"@includes echo hello", TaskLine},
 		{"INVAlID LINE", InvalidLine},
 		{"this is an invalid line", InvalidLine},
 	}
@@ -100,3 +118,279 @@ func TestParseCrontab(t *testing.T) {
 		})
 	}
 }
+
+func TestParseCrontab_dependencies(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Input string
+		Error error
+	}{
+		{"valid", "NAME=a\n@daily echo a\nNAME=b\nAFTER=a\n@after echo b\nNAME=c\nAFTER=\nAFTER_FAILURE=b\n@after echo c", nil},
+		{"duplicated", "NAME=a\n@daily echo a\n@daily echo b", ErrDuplicatedName},
+		{"unknown", "NAME=a\n@daily echo a\nNAME=b\nAFTER=x\n@after echo b", ErrUnknownTask},
+		{"self", "NAME=a\nAFTER=a\n@after echo a", ErrDependencyCycle},
+		{"cycle", "NAME=a\nAFTER=c\n@after echo a\nNAME=b\nAFTER=a\n@after echo b\nNAME=c\nAFTER=b\n@after echo c", ErrDependencyCycle},
+		{"after-without-schedule", "NAME=a\n@daily echo a\nAFTER=a\nNAME=b\n@daily echo b", ErrInvalidAfter},
+		{"schedule-without-after", "@after echo a", ErrInvalidAfter},
+		{"same-group-limit", "CONCURRENCY_GROUP=x\nCONCURRENCY_LIMIT=2\n@daily echo a\n@daily echo b", nil},
+		{"conflicting-group-limit", "CONCURRENCY_GROUP=x\nCONCURRENCY_LIMIT=2\n@daily echo a\nCONCURRENCY_LIMIT=3\n@daily echo b", ErrConflictingLimit},
+		{"default-group-limit", "CONCURRENCY_GROUP=x\n@daily echo a\nCONCURRENCY_LIMIT=3\n@daily echo b", nil},
+		{"invalid-group-limit", "CONCURRENCY_GROUP=x\nCONCURRENCY_LIMIT=0\n@daily echo a", ErrInvalidGroupLimit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			_, err := ParseCrontab("/path/to/crontab", strings.NewReader(tt.Input), Environ{})
+			if !errors.Is(err, tt.Error) {
+				t.Errorf("expected %v but got %v", tt.Error, err)
+			}
+		})
+	}
+}
+
+func TestParseCrontab_expandEnv(t *testing.T) {
+	ct, err := ParseCrontab("/path/to/crontab", strings.NewReader(strings.Join([]string{
+		"PATH=$BASE/bin",
+		"EXPAND_ENV=yes",
+		"PATH=$BASE/bin:$PATH",
+		"DATA=${DATA_DIR:-/var/lib}/app",
+		"MISSING=[$MISSING]",
+		"EXPAND_ENV=no",
+		"RAW=$BASE",
+		"@daily echo hello",
+	}, "\n")), Environ{"BASE=/opt", "PATH=/usr/bin"})
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+
+	env := ct.Tasks[0].Env
+	expected := map[string]string{
+		"PATH":    "/opt/bin:$BASE/bin",
+		"DATA":    "/var/lib/app",
+		"MISSING": "[]",
+		"RAW":     "$BASE",
+	}
+	for k, v := range expected {
+		if actual := env.Get(k, ""); actual != v {
+			t.Errorf("%s: expected %q but got %q", k, v, actual)
+		}
+	}
+
+	tests := []struct {
+		Input string
+		Error error
+		Line  int
+	}{
+		{"EXPAND_ENV=strict\nX=$MISSING", ErrUndefinedVariable, 2},
+		{"EXPAND_ENV=strict\nX=${MISSING:-ok}\nY=${X}", nil, 0},
+		{"EXPAND_ENV=yes\nX=${BROKEN", ErrBadSubstitution, 2},
+		{"EXPAND_ENV=sometimes\nX=1", ErrInvalidExpandMode, 1},
+		{"EXPAND_ENV=bogus\n@daily echo hello", ErrInvalidExpandMode, 1},
+	}
+	for _, tt := range tests {
+		_, err := ParseCrontab("/path/to/crontab", strings.NewReader(tt.Input), Environ{})
+		if !errors.Is(err, tt.Error) {
+			t.Errorf("%q: expected %v but got %v", tt.Input, tt.Error, err)
+		} else if err != nil && !strings.HasPrefix(err.Error(), fmt.Sprintf("%d: ", tt.Line)) {
+			t.Errorf("%q: expected error at line %d but got %s", tt.Input, tt.Line, err)
+		}
+	}
+}
+
+func TestParseCrontab_multiline(t *testing.T) {
+	ct, err := ParseCrontab("/path/to/crontab", strings.NewReader(strings.Join([]string{
+		"# comment \\",
+		"@daily echo \\",
+		"    hello \\",
+		"\tworld",
+		"@hourly sh <<EOF",
+		"echo 50%",
+		"  echo indented",
+		"EOF",
+		"@weekly cat<<-'END'",
+		"\tfoo",
+		"\t  bar",
+		"\tEND",
+		"@monthly cat <<<here",
+	}, "\n")), Environ{})
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+
+	tests := []struct {
+		Command string
+		Stdin   string
+		Args    string
+		String  string
+	}{
+		{"echo hello world", "", "hello world", "@daily  echo hello world"},
+		{"sh", "echo 50%\n  echo indented\n", "<<EOF\necho 50%\n  echo indented\nEOF", "@hourly  sh <<EOF\necho 50%\n  echo indented\nEOF"},
+		{"cat", "foo\nbar\n", "<<END\nfoo\nbar\nEND", "@weekly  cat <<END\nfoo\nbar\nEND"},
+		{"cat <<<here", "", "<<<here", "@monthly  cat <<<here"},
+	}
+	if len(ct.Tasks) != len(tests) {
+		t.Fatalf("expected %d tasks but got %d", len(tests), len(ct.Tasks))
+	}
+	for i, tt := range tests {
+		task := ct.Tasks[i]
+		if task.Command != tt.Command || task.Stdin != tt.Stdin {
+			t.Errorf("%d: unexpected command: %q %q", i, task.Command, task.Stdin)
+		}
+		if args := task.CommandArgs(); args != tt.Args {
+			t.Errorf("%d: expected args %q but got %q", i, tt.Args, args)
+		}
+		if s := task.String(); s != tt.String {
+			t.Errorf("%d: expected %q but got %q", i, tt.String, s)
+		}
+
+		// The rendered task should be parsed as the same task.
+		re, err := ParseCrontab("/path/to/crontab", strings.NewReader(task.String()), Environ{})
+		if err != nil {
+			t.Errorf("%d: failed to parse rendered task: %s", i, err)
+		} else if re.Tasks[0].Command != task.Command || re.Tasks[0].Stdin != task.Stdin {
+			t.Errorf("%d: rendered task is parsed as %q %q", i, re.Tasks[0].Command, re.Tasks[0].Stdin)
+		}
+	}
+
+	errTests := []struct {
+		Input string
+		Error error
+	}{
+		{"X=1\n@daily cat <<EOF\nhello\n", ErrUnterminatedHeredoc},
+		{"X=1\n@daily cat %hello <<EOF\nworld\nEOF", ErrInvalidHeredoc},
+		{"X=1\n@daily echo \\\nhello\ninvalid line", ErrInvalidLine},
+	}
+	for _, tt := range errTests {
+		_, err := ParseCrontab("/path/to/crontab", strings.NewReader(tt.Input), Environ{})
+		if !errors.Is(err, tt.Error) {
+			t.Errorf("%q: expected %v but got %v", tt.Input, tt.Error, err)
+		}
+	}
+	if _, err := ParseCrontab("/path/to/crontab", strings.NewReader("X=1\n@daily cat <<EOF\nhello\n"), Environ{}); err == nil || !strings.HasPrefix(err.Error(), "2: ") {
+		t.Errorf("error does not include the first line number: %v", err)
+	}
+
+	// Only task lines can continue.
+	ct, err = ParseCrontab("/path/to/crontab", strings.NewReader("FOO=bar \\\n@reboot echo hello"), Environ{})
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if len(ct.Tasks) != 1 {
+		t.Fatalf("expected 1 task but got %d", len(ct.Tasks))
+	}
+	if v := ct.Tasks[0].Env.Get("FOO", ""); v != `bar \` {
+		t.Errorf("unexpected FOO: %q", v)
+	}
+}
+
+func TestParseCrontab_options(t *testing.T) {
+	ct, err := ParseCrontab("/path/to/crontab", strings.NewReader(strings.Join([]string{
+		"TIMEOUT=10m",
+		"# concron: name=backup timeout=1h",
+		"# a normal comment",
+		"# concron: retries=2 name='daily backup'",
+		"@daily echo backup",
+		"# concron: managed by ansible",
+		"@hourly echo other",
+	}, "\n")), Environ{})
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+
+	if len(ct.Tasks) != 2 {
+		t.Fatalf("expected 2 tasks but got %d", len(ct.Tasks))
+	}
+	if task := ct.Tasks[0]; task.Name != "daily backup" || task.Timeout != time.Hour || task.RetryCount != 2 {
+		t.Errorf("options are not applied: name=%q timeout=%s retries=%d", task.Name, task.Timeout, task.RetryCount)
+	}
+	if task := ct.Tasks[1]; task.Name != "" || task.Timeout != 10*time.Minute || task.RetryCount != 0 {
+		t.Errorf("options are leaked to the next task: name=%q timeout=%s retries=%d", task.Name, task.Timeout, task.RetryCount)
+	}
+
+	tests := []struct {
+		Input string
+		Error error
+	}{
+		{"X=1\n# concron: colour=red\n@daily echo hello", ErrUnknownOption},
+		{"X=1\n# concron: name='broken\n@daily echo hello", ErrInvalidOption},
+		{"X=1\n# concron: name=daily backup\n@daily echo hello", ErrInvalidOption},
+		{"X=1\n# concron: name=x timeout 1h\n@daily echo hello", ErrInvalidOption},
+		{"X=1\n# concron: name=orphan\n", ErrOrphanOption},
+	}
+	for _, tt := range tests {
+		_, err := ParseCrontab("/path/to/crontab", strings.NewReader(tt.Input), Environ{})
+		if !errors.Is(err, tt.Error) {
+			t.Errorf("%q: expected %v but got %v", tt.Input, tt.Error, err)
+		} else if !strings.HasPrefix(err.Error(), "2: ") {
+			t.Errorf("%q: error does not include line number: %s", tt.Input, err)
+		}
+	}
+}
+
+func TestParseCrontab_include(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"common.env":       "SHELL=/bin/bash\nCRON_TZ=Asia/Tokyo\n@include shared/path.env",
+		"shared/path.env":  "# nested include is relative to this file\nPATH=/opt/bin",
+		"loop-a.env":       "A=1\n@include loop-b.env",
+		"loop-b.env":       "B=1\n@include loop-a.env",
+		"with-task.env":    "X=1\n@daily echo hello",
+		"invalid.env":      "X=1\ninvalid line",
+		"shared/empty.env": "",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to make directory: %s", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	ct, err := ParseCrontab(filepath.Join(dir, "crontab"), strings.NewReader(strings.Join([]string{
+		"SHELL=/bin/sh",
+		"@include common.env",
+		"@include " + filepath.Join(dir, "shared/empty.env"),
+		"@include common.env",
+		"@daily echo hello",
+	}, "\n")), Environ{})
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+
+	expected := Environ{"SHELL=/bin/bash", "CRON_TZ=Asia/Tokyo", "PATH=/opt/bin"}
+	if !reflect.DeepEqual(ct.Tasks[0].Env, expected) {
+		t.Errorf("unexpected env: %#v", ct.Tasks[0].Env)
+	}
+
+	includes := []string{
+		filepath.Join(dir, "common.env"),
+		filepath.Join(dir, "shared/path.env"),
+		filepath.Join(dir, "shared/empty.env"),
+	}
+	if !reflect.DeepEqual(ct.IncludedFiles, includes) {
+		t.Errorf("unexpected included files: %#v", ct.IncludedFiles)
+	}
+
+	tests := []struct {
+		Input  string
+		Error  error
+		Prefix string
+	}{
+		{"\n@include loop-a.env", ErrIncludeLoop, "2: " + filepath.Join(dir, "loop-a.env") + ": 2: " + filepath.Join(dir, "loop-b.env") + ": 2: "},
+		{"@include crontab", ErrIncludeLoop, "1: "},
+		{"@include with-task.env", ErrTaskInInclude, "1: " + filepath.Join(dir, "with-task.env") + ": 2: "},
+		{"@include invalid.env", ErrInvalidLine, "1: " + filepath.Join(dir, "invalid.env") + ": 2: "},
+		{"@include missing.env", os.ErrNotExist, "1: "},
+		{"@include", ErrInvalidLine, "1: "},
+	}
+	for _, tt := range tests {
+		_, err := ParseCrontab(filepath.Join(dir, "crontab"), strings.NewReader(tt.Input), Environ{})
+		if !errors.Is(err, tt.Error) {
+			t.Errorf("%q: expected %v but got %v", tt.Input, tt.Error, err)
+		} else if !strings.HasPrefix(err.Error(), tt.Prefix) {
+			t.Errorf("%q: unexpected error location: %s", tt.Input, err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+var (
+	ErrInvalidDSTPolicy = errors.New("invalid DST policy")
+)
+
+// DSTPolicy is a policy to decide when to run tasks that scheduled in the time skipped or repeated by daylight saving time.
+type DSTPolicy uint8
+
+const (
+	// DSTDefault skips the runs in the skipped time, and runs twice in the repeated time.
+	DSTDefault DSTPolicy = iota
+
+	// DSTVixie runs the skipped runs right after the skipped time, and runs only once in the repeated time, like Vixie cron.
+	// Tasks that have wildcard in the time fields, like "*/10 * * * *", are not affected.
+	DSTVixie
+)
+
+// ParseDSTPolicy parses a value of DST_POLICY.
+func ParseDSTPolicy(s string) (DSTPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "default":
+		return DSTDefault, nil
+	case "vixie":
+		return DSTVixie, nil
+	default:
+		return DSTDefault, fmt.Errorf("%w: %q", ErrInvalidDSTPolicy, s)
+	}
+}
+
+func (p DSTPolicy) String() string {
+	switch p {
+	case DSTDefault:
+		return "default"
+	case DSTVixie:
+		return "vixie"
+	default:
+		return "unknown"
+	}
+}
+
+// isFixedTimeSpec checks if the spec runs at fixed times of day.
+// The spec that has wildcard in the seconds, minutes, or hours field is not fixed.
+func isFixedTimeSpec(spec string) bool {
+	if strings.HasPrefix(spec, "@") {
+		return spec != "@hourly" && !strings.HasPrefix(spec, "@every")
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) < 5 {
+		return false
+	}
+	for _, f := range fields[:len(fields)-3] {
+		if strings.HasPrefix(f, "*") {
+			return false
+		}
+	}
+	return true
+}
+
+// VixieSchedule is a cron.Schedule that handles daylight saving time in the same way as Vixie cron.
+//
+// Wall is the schedule in UTC, that treated as the wall clock in Location.
+// If the wall clock time is skipped, VixieSchedule activates at the end of the skipped time.
+// If the wall clock time is repeated, VixieSchedule activates only at the first time.
+type VixieSchedule struct {
+	Wall     cron.Schedule
+	Location *time.Location
+}
+
+// NewVixieSchedule makes a VixieSchedule for the spec in the timezone.
+func NewVixieSchedule(spec, tz string, withSeconds bool) (VixieSchedule, error) {
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return VixieSchedule{}, err
+	}
+
+	wall, err := ParseSchedule(spec, "UTC", withSeconds)
+	if err != nil {
+		return VixieSchedule{}, err
+	}
+
+	return VixieSchedule{Wall: wall, Location: loc}, nil
+}
+
+// Next implements cron.Schedule.
+func (s VixieSchedule) Next(t time.Time) time.Time {
+	w := wallClock(t, s.Location)
+	for {
+		w = s.Wall.Next(w)
+		if w.IsZero() {
+			return w
+		}
+
+		// The wall clock time can be already passed if t is in the repeated time.
+		if next := fromWallClock(w, s.Location); next.After(t) {
+			return next.In(s.Location)
+		}
+	}
+}
+
+// wallClock returns the wall clock time of t in loc, as UTC time.
+func wallClock(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// fromWallClock returns the first time that the wall clock in loc shows w.
+// If w is skipped by daylight saving time, it returns the end of the skipped time.
+//
+// It assumes that the offset of loc changes at most once in a day around w.
+func fromWallClock(w time.Time, loc *time.Location) time.Time {
+	_, before := w.Add(-24 * time.Hour).In(loc).Zone()
+	_, after := w.Add(24 * time.Hour).In(loc).Zone()
+
+	var first time.Time
+	for _, offset := range []int{before, after} {
+		t := w.Add(-time.Duration(offset) * time.Second)
+		if wallClock(t, loc).Equal(w) && (first.IsZero() || t.Before(first)) {
+			first = t
+		}
+	}
+	if !first.IsZero() {
+		return first
+	}
+
+	// w is in the skipped time. Search the time that offset changes.
+	lo := w.Add(-time.Duration(after) * time.Second)
+	hi := w.Add(-time.Duration(before) * time.Second)
+	for hi.Sub(lo) > time.Nanosecond {
+		mid := lo.Add(hi.Sub(lo) / 2)
+		if _, offset := mid.In(loc).Zone(); offset == before {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDSTPolicy(t *testing.T) {
+	tests := []struct {
+		Input  string
+		Policy DSTPolicy
+		Error  bool
+	}{
+		{"", DSTDefault, false},
+		{"default", DSTDefault, false},
+		{"Vixie", DSTVixie, false},
+		{"skip", DSTDefault, true},
+	}
+
+	for _, tt := range tests {
+		p, err := ParseDSTPolicy(tt.Input)
+		if (err != nil) != tt.Error {
+			t.Errorf("%q: unexpected error: %v", tt.Input, err)
+		}
+		if p != tt.Policy {
+			t.Errorf("%q: expected %s but got %s", tt.Input, tt.Policy, p)
+		}
+	}
+}
+
+func TestIsFixedTimeSpec(t *testing.T) {
+	tests := []struct {
+		Spec  string
+		Fixed bool
+	}{
+		{"30 2 * * *", true},
+		{"30 1-3 * * 1-5", true},
+		{"0 30 2 * * *", true},
+		{"*/30 * * * *", false},
+		{"0 * * * *", false},
+		{"30 */2 * * *", false},
+		{"*/15 30 2 * * *", false},
+		{"@daily", true},
+		{"@weekly", true},
+		{"@hourly", false},
+		{"@every 1h", false},
+	}
+
+	for _, tt := range tests {
+		if fixed := isFixedTimeSpec(tt.Spec); fixed != tt.Fixed {
+			t.Errorf("%q: expected %v but got %v", tt.Spec, tt.Fixed, fixed)
+		}
+	}
+}
+
+func TestParseTask_dstPolicy(t *testing.T) {
+	tests := []struct {
+		Input  string
+		Env    Environ
+		From   string
+		Expect []string
+	}{
+		// Spring forward in Berlin: 02:00 CET -> 03:00 CEST.
+		{"30 2 * * *", Environ{"CRON_TZ=Europe/Berlin"}, "2022-03-27T00:00:00+01:00", []string{"03-28 02:30:00 CEST", "03-29 02:30:00 CEST"}},
+		{"30 2 * * *", Environ{"CRON_TZ=Europe/Berlin", "DST_POLICY=vixie"}, "2022-03-27T00:00:00+01:00", []string{"03-27 03:00:00 CEST", "03-28 02:30:00 CEST", "03-29 02:30:00 CEST"}},
+		{"0,30 2 * * *", Environ{"CRON_TZ=Europe/Berlin", "DST_POLICY=vixie"}, "2022-03-27T00:00:00+01:00", []string{"03-27 03:00:00 CEST", "03-28 02:00:00 CEST", "03-28 02:30:00 CEST"}},
+		{"30 1-3 * * *", Environ{"CRON_TZ=Europe/Berlin", "DST_POLICY=vixie"}, "2022-03-27T00:00:00+01:00", []string{"03-27 01:30:00 CET", "03-27 03:00:00 CEST", "03-27 03:30:00 CEST", "03-28 01:30:00 CEST"}},
+		{"*/30 * * * *", Environ{"CRON_TZ=Europe/Berlin", "DST_POLICY=vixie"}, "2022-03-27T01:00:00+01:00", []string{"03-27 01:30:00 CET", "03-27 03:00:00 CEST", "03-27 03:30:00 CEST"}},
+		{"0 30 2 * * *", Environ{"CRON_TZ=Europe/Berlin", "DST_POLICY=vixie", "SCHEDULE_SECONDS=yes"}, "2022-03-27T00:00:00+01:00", []string{"03-27 03:00:00 CEST", "03-28 02:30:00 CEST"}},
+		{"0 0 L * *", Environ{"CRON_TZ=Europe/Berlin", "DST_POLICY=vixie"}, "2022-03-30T00:00:00+02:00", []string{"03-31 00:00:00 CEST", "04-30 00:00:00 CEST"}},
+
+		// Fall back in Berlin: 03:00 CEST -> 02:00 CET.
+		{"30 2 * * *", Environ{"CRON_TZ=Europe/Berlin"}, "2022-10-30T00:00:00+02:00", []string{"10-30 02:30:00 CEST", "10-30 02:30:00 CET", "10-31 02:30:00 CET"}},
+		{"30 2 * * *", Environ{"CRON_TZ=Europe/Berlin", "DST_POLICY=vixie"}, "2022-10-30T00:00:00+02:00", []string{"10-30 02:30:00 CEST", "10-31 02:30:00 CET", "11-01 02:30:00 CET"}},
+		{"30 2 * * *", Environ{"CRON_TZ=Europe/Berlin", "DST_POLICY=vixie"}, "2022-10-30T02:10:00+01:00", []string{"10-31 02:30:00 CET"}},
+		{"30 1-3 * * *", Environ{"CRON_TZ=Europe/Berlin", "DST_POLICY=vixie"}, "2022-10-30T00:00:00+02:00", []string{"10-30 01:30:00 CEST", "10-30 02:30:00 CEST", "10-30 03:30:00 CET", "10-31 01:30:00 CET"}},
+		{"*/30 * * * *", Environ{"CRON_TZ=Europe/Berlin", "DST_POLICY=vixie"}, "2022-10-30T01:45:00+02:00", []string{"10-30 02:00:00 CEST", "10-30 02:30:00 CEST", "10-30 02:00:00 CET", "10-30 02:30:00 CET", "10-30 03:00:00 CET"}},
+
+		// New York.
+		{"30 2 * * *", Environ{"CRON_TZ=America/New_York", "DST_POLICY=vixie"}, "2022-03-13T00:00:00-05:00", []string{"03-13 03:00:00 EDT", "03-14 02:30:00 EDT"}},
+		{"30 1 * * *", Environ{"CRON_TZ=America/New_York", "DST_POLICY=vixie"}, "2022-11-06T00:00:00-04:00", []string{"11-06 01:30:00 EDT", "11-07 01:30:00 EST"}},
+		{"30 1 * * *", Environ{"CRON_TZ=America/New_York"}, "2022-11-06T00:00:00-04:00", []string{"11-06 01:30:00 EDT", "11-06 01:30:00 EST", "11-07 01:30:00 EST"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s/%s", tt.Input, strings.Join(tt.Env, ","), tt.From), func(t *testing.T) {
+			task, err := ParseTask("test", tt.Input+"  echo hello", tt.Env)
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+
+			next, err := time.Parse(time.RFC3339, tt.From)
+			if err != nil {
+				t.Fatalf("failed to parse from time: %s", err)
+			}
+
+			loc, err := time.LoadLocation(tt.Env.Get("CRON_TZ", ""))
+			if err != nil {
+				t.Fatalf("failed to load timezone: %s", err)
+			}
+
+			var got []string
+			for range tt.Expect {
+				next = task.Schedule.Next(next)
+				got = append(got, next.In(loc).Format("01-02 15:04:05 MST"))
+			}
+
+			if strings.Join(got, ", ") != strings.Join(tt.Expect, ", ") {
+				t.Errorf("unexpected schedule\nexpected: %v\n but got: %v", tt.Expect, got)
+			}
+		})
+	}
+}
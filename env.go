@@ -1,12 +1,49 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 )
 
+var (
+	ErrInvalidExpandMode = errors.New(`EXPAND_ENV must be "yes", "no", or "strict"`)
+	ErrUndefinedVariable = errors.New("undefined variable")
+	ErrBadSubstitution   = errors.New("bad substitution")
+)
+
+// ExpandMode is how to expand variables in values of environment variables.
+type ExpandMode uint8
+
+const (
+	// ExpandNone does not expand variables.
+	ExpandNone ExpandMode = iota
+
+	// ExpandEmpty expands variables, and undefined variables are expanded to empty string.
+	ExpandEmpty
+
+	// ExpandStrict expands variables, and undefined variables are error.
+	ExpandStrict
+)
+
+// ParseExpandMode parses a value of EXPAND_ENV.
+func ParseExpandMode(s string) (ExpandMode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "false", "0", "no", "disable", "disabled":
+		return ExpandNone, nil
+	case "true", "1", "yes", "enable", "enabled":
+		return ExpandEmpty, nil
+	case "strict":
+		return ExpandStrict, nil
+	default:
+		return ExpandNone, fmt.Errorf("%w: %q", ErrInvalidExpandMode, s)
+	}
+}
+
 // Environ is the environment variable manager.
 type Environ []string
 
@@ -72,7 +109,29 @@ func (e *Environ) Set(s string) {
 	if k == "" {
 		return
 	}
+	e.set(k, v)
+}
+
+// SetExpand is the same as Set, but it expands variables in the value following the mode.
+// The file references like ${file:/run/secrets/password} are always expanded to the content of the file, regardless of the mode.
+// The result is the contents of the files that referenced, that should be treated as secrets.
+// See also Expand.
+func (e *Environ) SetExpand(s string, mode ExpandMode) (secrets []string, err error) {
+	k, v := ParseEnv(s)
+	if k == "" {
+		return nil, nil
+	}
+
+	x := &expander{env: *e, mode: mode}
+	v, err = x.expand(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", k, err)
+	}
+	e.set(k, v)
+	return x.secrets, nil
+}
 
+func (e *Environ) set(k, v string) {
 	prefix := k + "="
 	for i := range *e {
 		if strings.HasPrefix((*e)[i], prefix) {
@@ -85,11 +144,8 @@ func (e *Environ) Set(s string) {
 
 // GetAllowEmpty is the almost same as Get, but it consider empty value is a value.
 func (e Environ) GetAllowEmpty(key, defaultValue string) string {
-	key = key + "="
-	for _, x := range e {
-		if strings.HasPrefix(x, key) {
-			return strings.SplitN(x, "=", 2)[1]
-		}
+	if v, ok := e.Lookup(key); ok {
+		return v
 	}
 	return defaultValue
 }
@@ -115,3 +171,210 @@ func (e Environ) GetBool(key string) bool {
 		return true
 	}
 }
+
+// GetDuration gets time.Duration value from the Environ.
+// If the Environ has no value for the key, it returns the defaultValue.
+func (e Environ) GetDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	v := e.Get(key, "")
+	if v == "" {
+		return defaultValue, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return d, nil
+}
+
+// GetInt gets integer value from the Environ.
+// If the Environ has no value for the key, it returns the defaultValue.
+func (e Environ) GetInt(key string, defaultValue int) (int, error) {
+	v := e.Get(key, "")
+	if v == "" {
+		return defaultValue, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return i, nil
+}
+
+// GetFloat gets floating point value from the Environ.
+// If the Environ has no value for the key, it returns the defaultValue.
+func (e Environ) GetFloat(key string, defaultValue float64) (float64, error) {
+	v := e.Get(key, "")
+	if v == "" {
+		return defaultValue, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return f, nil
+}
+
+// Lookup returns the value for the specified key, and reports whether the key is defined.
+func (e Environ) Lookup(key string) (value string, ok bool) {
+	key = key + "="
+	for _, x := range e {
+		if strings.HasPrefix(x, key) {
+			return x[len(key):], true
+		}
+	}
+	return "", false
+}
+
+// Expand expands variables in s using the variables in this Environ.
+//
+// It supports $VAR, ${VAR}, and ${VAR:-default}, and "$$" is replaced with "$".
+// The default value is used if the variable is undefined or empty, and it can also include variables.
+// ${file:PATH} is replaced with the content of the file, without trailing newlines.
+// If strict is true, undefined variables without default value are error. Otherwise, they are expanded to empty string.
+func (e Environ) Expand(s string, strict bool) (string, error) {
+	x := &expander{env: e, mode: ExpandEmpty}
+	if strict {
+		x.mode = ExpandStrict
+	}
+	return x.expand(s)
+}
+
+// expander expands variables and file references in a value.
+type expander struct {
+	env     Environ
+	mode    ExpandMode
+	secrets []string
+}
+
+func (x *expander) expand(s string) (string, error) {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		switch c := s[i+1]; {
+		case x.mode == ExpandNone && !strings.HasPrefix(s[i:], "${file:"):
+			b.WriteByte('$')
+		case c == '$':
+			b.WriteByte('$')
+			i++
+		case c == '{':
+			end := closingBrace(s, i+1)
+			if end < 0 {
+				return "", fmt.Errorf("%w: %q", ErrBadSubstitution, s[i:])
+			}
+			v, err := x.expandBraced(s[i+2 : end])
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(v)
+			i = end
+		case isNameStart(c):
+			j := i + 2
+			for j < len(s) && (isNameStart(s[j]) || ('0' <= s[j] && s[j] <= '9')) {
+				j++
+			}
+			v, err := x.expandVariable(s[i+1 : j])
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(v)
+			i = j - 1
+		default:
+			b.WriteByte('$')
+		}
+	}
+
+	return b.String(), nil
+}
+
+// expandBraced expands the inside of "${...}".
+func (x *expander) expandBraced(expr string) (string, error) {
+	if strings.HasPrefix(expr, "file:") {
+		path, err := x.expand(expr[len("file:"):])
+		if err != nil {
+			return "", err
+		}
+		return x.readSecret(path)
+	}
+
+	name, def := expr, ""
+	hasDefault := false
+	if i := strings.Index(expr, ":-"); i >= 0 {
+		name, def, hasDefault = expr[:i], expr[i+2:], true
+	}
+
+	if !isName(name) {
+		return "", fmt.Errorf("%w: %q", ErrBadSubstitution, "${"+expr+"}")
+	}
+
+	if hasDefault {
+		if v, _ := x.env.Lookup(name); v != "" {
+			return v, nil
+		}
+		return x.expand(def)
+	}
+
+	return x.expandVariable(name)
+}
+
+func (x *expander) expandVariable(name string) (string, error) {
+	v, ok := x.env.Lookup(name)
+	if !ok && x.mode == ExpandStrict {
+		return "", fmt.Errorf("%w: %s", ErrUndefinedVariable, name)
+	}
+	return v, nil
+}
+
+// readSecret reads a file for ${file:PATH}, and records its content as a secret.
+func (x *expander) readSecret(path string) (string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	v := strings.TrimRight(string(raw), "\r\n")
+	if v != "" {
+		x.secrets = append(x.secrets, v)
+	}
+	return v, nil
+}
+
+// closingBrace returns the index of "}" that closes "{" at the start, or -1 if not found.
+func closingBrace(s string, start int) int {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isName(s string) bool {
+	if s == "" || !isNameStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isNameStart(s[i]) && !('0' <= s[i] && s[i] <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestParseEnv(t *testing.T) {
@@ -144,3 +146,85 @@ func TestEnviron_GetBool(t *testing.T) {
 		})
 	}
 }
+
+func TestEnviron_GetDuration(t *testing.T) {
+	tests := []struct {
+		Value string
+		Want  time.Duration
+		Error bool
+	}{
+		{"", 42 * time.Second, false},
+		{"30m", 30 * time.Minute, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"0", 0, false},
+		{"10", 0, true},
+		{"never", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Value, func(t *testing.T) {
+			actual, err := (Environ{"KEY=" + tt.Value}).GetDuration("KEY", 42*time.Second)
+			if tt.Error {
+				if err == nil {
+					t.Errorf("expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if actual != tt.Want {
+				t.Errorf("expected %s but got %s", tt.Want, actual)
+			}
+		})
+	}
+}
+
+func TestEnviron_Expand(t *testing.T) {
+	env := Environ{"HOME=/home/alice", "PATH=/usr/bin:/bin", "EMPTY="}
+
+	tests := []struct {
+		Input  string
+		Output string
+		Strict error
+	}{
+		{"$HOME/bin:$PATH", "/home/alice/bin:/usr/bin:/bin", nil},
+		{"${HOME}bin", "/home/alicebin", nil},
+		{"${EMPTY}", "", nil},
+		{"${UNDEFINED}", "", ErrUndefinedVariable},
+		{"$UNDEFINED", "", ErrUndefinedVariable},
+		{"${UNDEFINED:-default}", "default", nil},
+		{"${EMPTY:-default}", "default", nil},
+		{"${HOME:-default}", "/home/alice", nil},
+		{"${UNDEFINED:-$HOME/x}", "/home/alice/x", nil},
+		{"${UNDEFINED:-${EMPTY:-nested}}", "nested", nil},
+		{"costs $$5", "costs $5", nil},
+		{"$ and $1 and $", "$ and $1 and $", nil},
+		{"${HOME", "", ErrBadSubstitution},
+		{"${}", "", ErrBadSubstitution},
+		{"${1A}", "", ErrBadSubstitution},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Input, func(t *testing.T) {
+			out, err := env.Expand(tt.Input, false)
+			if errors.Is(tt.Strict, ErrBadSubstitution) {
+				if !errors.Is(err, ErrBadSubstitution) {
+					t.Errorf("expected bad substitution but got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if out != tt.Output {
+				t.Errorf("expected %q but got %q", tt.Output, out)
+			}
+
+			_, err = env.Expand(tt.Input, true)
+			if !errors.Is(err, tt.Strict) {
+				t.Errorf("strict: expected %v but got %v", tt.Strict, err)
+			}
+		})
+	}
+}
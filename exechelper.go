@@ -0,0 +1,5 @@
+package main
+
+// ExecHelperArg is the first argument to run Concron as the exec helper.
+// See RunExecHelper.
+const ExecHelperArg = "--concron-exec-helper"
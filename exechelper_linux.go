@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// useExecHelper rewrites exec.Cmd to execute via Concron itself as the exec helper, and adds options for the helper.
+//
+// Go can not run code in the child process between fork and exec.
+// The helper does the setup such as resource limits, and then executes the original command.
+func useExecHelper(cmd *exec.Cmd, opts ...string) error {
+	if len(cmd.Args) < 2 || cmd.Args[1] != ExecHelperArg {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+
+		cmd.Args = append([]string{exe, ExecHelperArg, "--", cmd.Path}, cmd.Args...)
+		cmd.Path = exe
+	}
+
+	args := append([]string{}, cmd.Args[:2]...)
+	args = append(args, opts...)
+	cmd.Args = append(args, cmd.Args[2:]...)
+
+	return nil
+}
+
+// RunExecHelper sets up the current process and executes the command.
+// The args is the arguments after ExecHelperArg: options, "--", path to the command, and arguments of the command including argv[0].
+// It returns only if failed.
+func RunExecHelper(args []string) (exitCode int) {
+	fs := flag.NewFlagSet(ExecHelperArg, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	rlimit := fs.String("rlimit", "", "Resource limits to set.")
+	nice := fs.String("nice", "", "Nice value to set.")
+	ionice := fs.String("ionice", "", "I/O scheduling class and level to set.")
+	waitFD := fs.Int("wait-fd", -1, "File descriptor to wait for the parent process to finish setup.")
+
+	if err := fs.Parse(args); err != nil || fs.NArg() < 2 {
+		fmt.Fprintln(os.Stderr, "concron: invalid arguments for the exec helper")
+		return 127
+	}
+
+	if *waitFD >= 0 {
+		f := os.NewFile(uintptr(*waitFD), "wait-fd")
+		var buf [1]byte
+		_, err := f.Read(buf[:])
+		f.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "concron: failed to set up the task")
+			return 127
+		}
+	}
+
+	ls, err := decodeResourceLimits(*rlimit)
+	if err == nil {
+		err = applyResourceLimits(ls)
+	}
+	if err == nil && *nice != "" {
+		var n int
+		if n, err = strconv.Atoi(*nice); err == nil {
+			err = applyNice(n)
+		}
+	}
+	if err == nil && *ionice != "" {
+		err = applyIONice(*ionice)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "concron: %s\n", err)
+		return 127
+	}
+
+	err = unix.Exec(fs.Arg(0), fs.Args()[1:], os.Environ())
+	fmt.Fprintf(os.Stderr, "concron: failed to execute %s: %s\n", fs.Arg(0), err)
+	return 127
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// RunExecHelper sets up the current process and executes the command.
+// It is not supported except Linux.
+func RunExecHelper(args []string) (exitCode int) {
+	fmt.Fprintln(os.Stderr, "concron: the exec helper is not supported in "+runtime.GOOS)
+	return 127
+}
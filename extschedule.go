@@ -0,0 +1,344 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+var (
+	ErrInvalidDaySpec = errors.New("invalid day spec")
+)
+
+// extendedSearchLimit is how far ExtendedSchedule searches the next activation.
+const extendedSearchLimit = 5 * 366 * 24 * time.Hour
+
+var dowNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// ParseSchedule parses a schedule spec in the timezone.
+// If withSeconds is true, the spec has the seconds field as the first field.
+//
+// In addition to the standard spec, it supports the extensions in the day fields: L, L-n, nW, and LW in the day of month, and nL and n#k in the day of week.
+func ParseSchedule(spec, tz string, withSeconds bool) (cron.Schedule, error) {
+	parser := cron.ParseStandard
+	if withSeconds {
+		parser = secondsParser.Parse
+	}
+
+	fields := strings.Fields(spec)
+	if strings.HasPrefix(spec, "@") || !hasDayExtension(fields) {
+		return parser("CRON_TZ=" + tz + " " + spec)
+	}
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, err
+	}
+
+	domIdx, dowIdx := len(fields)-3, len(fields)-1
+
+	s := &ExtendedSchedule{Location: loc}
+
+	s.Dom, s.DomAny, err = parseDomField(fields[domIdx])
+	if err != nil {
+		return nil, err
+	}
+	s.Dow, s.DowAny, err = parseDowField(fields[dowIdx])
+	if err != nil {
+		return nil, err
+	}
+
+	base := append([]string{}, fields...)
+	base[domIdx] = "*"
+	base[dowIdx] = "*"
+	s.Base, err = parser("CRON_TZ=" + tz + " " + strings.Join(base, " "))
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// hasDayExtension checks if the day fields of the spec use L, W, or #.
+func hasDayExtension(fields []string) bool {
+	if len(fields) < 5 {
+		return false
+	}
+	dom, dow := fields[len(fields)-3], fields[len(fields)-1]
+	return strings.ContainsAny(dom, "LW") || strings.ContainsAny(dow, "L#")
+}
+
+// dayMatcher checks if the day matches to a part of day field.
+type dayMatcher func(year int, month time.Month, day int) bool
+
+// ExtendedSchedule is a cron.Schedule that supports L, W, and # in the day fields.
+//
+// Base is the schedule that the day fields are "*".
+// The day fields are checked in Location, and matching rule is the same as standard cron: if both of day fields are restricted, it matches if either of them matches.
+type ExtendedSchedule struct {
+	Base     cron.Schedule
+	Location *time.Location
+	Dom      []dayMatcher
+	DomAny   bool
+	Dow      []dayMatcher
+	DowAny   bool
+}
+
+// Next implements cron.Schedule.
+func (s *ExtendedSchedule) Next(t time.Time) time.Time {
+	limit := t.Add(extendedSearchLimit)
+
+	for next := s.Base.Next(t); !next.IsZero() && next.Before(limit); {
+		next = next.In(s.Location)
+		y, m, d := next.Date()
+		if s.match(y, m, d) {
+			return next
+		}
+
+		// Skip to the beginning of the next day.
+		// Base.Next rounds up the time to the next second, so 1 nanosecond earlier gives the first activation in the next day.
+		next = s.Base.Next(time.Date(y, m, d+1, 0, 0, 0, 0, s.Location).Add(-time.Nanosecond))
+	}
+
+	return time.Time{}
+}
+
+func (s *ExtendedSchedule) match(year int, month time.Month, day int) bool {
+	dom := matchAny(s.Dom, year, month, day)
+	dow := matchAny(s.Dow, year, month, day)
+
+	switch {
+	case s.DomAny && s.DowAny:
+		return true
+	case s.DomAny:
+		return dow
+	case s.DowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+func matchAny(ms []dayMatcher, year int, month time.Month, day int) bool {
+	for _, m := range ms {
+		if m(year, month, day) {
+			return true
+		}
+	}
+	return false
+}
+
+// daysIn returns the number of days in the month.
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+func weekday(year int, month time.Month, day int) time.Weekday {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Weekday()
+}
+
+// nearestWeekday returns the weekday nearest to the day in the same month.
+func nearestWeekday(year int, month time.Month, day int) int {
+	last := daysIn(year, month)
+	switch weekday(year, month, day) {
+	case time.Saturday:
+		if day == 1 {
+			return day + 2
+		}
+		return day - 1
+	case time.Sunday:
+		if day == last {
+			return day - 2
+		}
+		return day + 1
+	default:
+		return day
+	}
+}
+
+// parseDomField parses the day of month field.
+func parseDomField(field string) (ms []dayMatcher, anyDay bool, err error) {
+	if field == "*" || field == "?" {
+		return nil, true, nil
+	}
+
+	for _, x := range strings.Split(field, ",") {
+		m, err := parseDomExpr(x)
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: %q", ErrInvalidDaySpec, x)
+		}
+		ms = append(ms, m)
+	}
+	return ms, strings.HasPrefix(field, "*"), nil
+}
+
+func parseDomExpr(expr string) (dayMatcher, error) {
+	switch {
+	case expr == "L":
+		return func(y int, m time.Month, d int) bool {
+			return d == daysIn(y, m)
+		}, nil
+	case expr == "LW":
+		return func(y int, m time.Month, d int) bool {
+			last := daysIn(y, m)
+			switch weekday(y, m, last) {
+			case time.Saturday:
+				last--
+			case time.Sunday:
+				last -= 2
+			}
+			return d == last
+		}, nil
+	case strings.HasPrefix(expr, "L-"):
+		n, err := strconv.Atoi(expr[2:])
+		if err != nil || n < 1 || n > 30 {
+			return nil, ErrInvalidDaySpec
+		}
+		return func(y int, m time.Month, d int) bool {
+			return d == daysIn(y, m)-n
+		}, nil
+	case strings.HasSuffix(expr, "W"):
+		n, err := strconv.Atoi(strings.TrimSuffix(expr, "W"))
+		if err != nil || n < 1 || n > 31 {
+			return nil, ErrInvalidDaySpec
+		}
+		return func(y int, m time.Month, d int) bool {
+			return n <= daysIn(y, m) && d == nearestWeekday(y, m, n)
+		}, nil
+	default:
+		bits, err := parseRangeExpr(expr, 1, 31, nil)
+		if err != nil {
+			return nil, err
+		}
+		return func(_ int, _ time.Month, d int) bool {
+			return bits&(1<<uint(d)) != 0
+		}, nil
+	}
+}
+
+// parseDowField parses the day of week field.
+func parseDowField(field string) (ms []dayMatcher, anyDay bool, err error) {
+	if field == "*" || field == "?" {
+		return nil, true, nil
+	}
+
+	for _, x := range strings.Split(field, ",") {
+		m, err := parseDowExpr(x)
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: %q", ErrInvalidDaySpec, x)
+		}
+		ms = append(ms, m)
+	}
+	return ms, strings.HasPrefix(field, "*"), nil
+}
+
+func parseDowExpr(expr string) (dayMatcher, error) {
+	switch {
+	case strings.HasSuffix(expr, "L"):
+		wd, err := parseWeekday(strings.TrimSuffix(expr, "L"))
+		if err != nil {
+			return nil, err
+		}
+		return func(y int, m time.Month, d int) bool {
+			return weekday(y, m, d) == wd && d+7 > daysIn(y, m)
+		}, nil
+	case strings.Contains(expr, "#"):
+		xs := strings.SplitN(expr, "#", 2)
+		wd, err := parseWeekday(xs[0])
+		if err != nil {
+			return nil, err
+		}
+		k, err := strconv.Atoi(xs[1])
+		if err != nil || k < 1 || k > 5 {
+			return nil, ErrInvalidDaySpec
+		}
+		return func(y int, m time.Month, d int) bool {
+			return weekday(y, m, d) == wd && (d-1)/7+1 == k
+		}, nil
+	default:
+		bits, err := parseRangeExpr(expr, 0, 7, dowNames)
+		if err != nil {
+			return nil, err
+		}
+		// Both of 0 and 7 are Sunday.
+		if bits&(1<<7) != 0 {
+			bits |= 1
+		}
+		return func(y int, m time.Month, d int) bool {
+			return bits&(1<<uint(weekday(y, m, d))) != 0
+		}, nil
+	}
+}
+
+// parseWeekday parses a single day of week, like "5" or "fri".
+func parseWeekday(s string) (time.Weekday, error) {
+	if n, ok := dowNames[strings.ToLower(s)]; ok {
+		return time.Weekday(n), nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 7 {
+		return 0, ErrInvalidDaySpec
+	}
+	return time.Weekday(n % 7), nil
+}
+
+// parseRangeExpr parses a standard cron expression like "*", "5", "1-5", or "*/2", and returns bits of the matched numbers.
+func parseRangeExpr(expr string, min, max int, names map[string]int) (uint64, error) {
+	rangePart, step := expr, 1
+	if i := strings.IndexRune(expr, '/'); i >= 0 {
+		var err error
+		step, err = strconv.Atoi(expr[i+1:])
+		if err != nil || step < 1 {
+			return 0, ErrInvalidDaySpec
+		}
+		rangePart = expr[:i]
+	}
+
+	parse := func(s string) (int, error) {
+		if n, ok := names[strings.ToLower(s)]; ok {
+			return n, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, ErrInvalidDaySpec
+		}
+		return n, nil
+	}
+
+	lo, hi := min, max
+	switch {
+	case rangePart == "*" || rangePart == "?":
+	case strings.Contains(rangePart, "-"):
+		xs := strings.SplitN(rangePart, "-", 2)
+		var err error
+		if lo, err = parse(xs[0]); err != nil {
+			return 0, err
+		}
+		if hi, err = parse(xs[1]); err != nil {
+			return 0, err
+		}
+		if lo > hi {
+			return 0, ErrInvalidDaySpec
+		}
+	default:
+		var err error
+		if lo, err = parse(rangePart); err != nil {
+			return 0, err
+		}
+		if step == 1 {
+			hi = lo
+		}
+	}
+
+	var bits uint64
+	for i := lo; i <= hi; i += step {
+		bits |= 1 << uint(i)
+	}
+	return bits, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		Spec        string
+		TZ          string
+		WithSeconds bool
+		From        string
+		Next        string
+	}{
+		// The last day of month, in months that have different length.
+		{"0 0 L * *", "", false, "2022-01-15T00:00:00Z", "2022-01-31T00:00:00Z"},
+		{"0 0 L * *", "", false, "2022-01-31T00:00:00Z", "2022-02-28T00:00:00Z"},
+		{"0 0 L * *", "", false, "2022-03-31T00:00:00Z", "2022-04-30T00:00:00Z"},
+
+		// Leap years.
+		{"0 0 L * *", "", false, "2023-02-01T00:00:00Z", "2023-02-28T00:00:00Z"},
+		{"0 0 L * *", "", false, "2024-02-01T00:00:00Z", "2024-02-29T00:00:00Z"},
+		{"0 0 L * *", "", false, "2100-02-01T00:00:00Z", "2100-02-28T00:00:00Z"},
+		{"0 0 L * *", "", false, "2000-02-01T00:00:00Z", "2000-02-29T00:00:00Z"},
+		{"0 12 L 2 *", "", false, "2022-03-01T00:00:00Z", "2023-02-28T12:00:00Z"},
+		{"0 12 L 2 *", "", false, "2023-03-01T00:00:00Z", "2024-02-29T12:00:00Z"},
+
+		// Days before the last day.
+		{"0 0 L-1 * *", "", false, "2024-02-01T00:00:00Z", "2024-02-28T00:00:00Z"},
+		{"0 0 L-30 * *", "", false, "2022-02-01T00:00:00Z", "2022-03-01T00:00:00Z"},
+
+		// The nearest weekday.
+		{"0 9 15W * *", "", false, "2022-01-01T00:00:00Z", "2022-01-14T09:00:00Z"},
+		{"0 9 15W * *", "", false, "2022-05-01T00:00:00Z", "2022-05-16T09:00:00Z"},
+		{"0 9 15W * *", "", false, "2022-02-01T00:00:00Z", "2022-02-15T09:00:00Z"},
+		{"0 0 1W * *", "", false, "2021-12-31T12:00:00Z", "2022-01-03T00:00:00Z"},
+		{"0 0 1W * *", "", false, "2022-04-30T00:00:00Z", "2022-05-02T00:00:00Z"},
+		{"0 0 31W * *", "", false, "2022-07-01T00:00:00Z", "2022-07-29T00:00:00Z"},
+		{"0 0 31W * *", "", false, "2022-02-01T00:00:00Z", "2022-03-31T00:00:00Z"},
+		{"0 0 30W * *", "", false, "2023-04-01T00:00:00Z", "2023-04-28T00:00:00Z"},
+
+		// The last weekday.
+		{"0 0 LW * *", "", false, "2022-04-01T00:00:00Z", "2022-04-29T00:00:00Z"},
+		{"0 0 LW * *", "", false, "2022-07-01T00:00:00Z", "2022-07-29T00:00:00Z"},
+		{"0 0 LW * *", "", false, "2023-04-01T00:00:00Z", "2023-04-28T00:00:00Z"},
+		{"0 0 LW * *", "", false, "2022-01-01T00:00:00Z", "2022-01-31T00:00:00Z"},
+
+		// The last specific day of week.
+		{"0 0 * * 5L", "", false, "2023-09-01T00:00:00Z", "2023-09-29T00:00:00Z"},
+		{"0 0 * * 5L", "", false, "2024-02-01T00:00:00Z", "2024-02-23T00:00:00Z"},
+		{"0 0 * * friL", "", false, "2022-01-01T00:00:00Z", "2022-01-28T00:00:00Z"},
+
+		// The n-th day of week.
+		{"0 0 * * 2#2", "", false, "2022-02-01T01:00:00Z", "2022-02-08T00:00:00Z"},
+		{"0 0 * * 2#2", "", false, "2022-06-01T00:00:00Z", "2022-06-14T00:00:00Z"},
+		{"0 0 * * MON#1", "", false, "2022-01-01T00:00:00Z", "2022-01-03T00:00:00Z"},
+		{"0 0 * * 1#5", "", false, "2022-01-01T00:00:00Z", "2022-01-31T00:00:00Z"},
+		{"0 0 * * 1#5", "", false, "2022-02-01T00:00:00Z", "2022-05-30T00:00:00Z"},
+		{"0 0 * * 7#1", "", false, "2022-01-01T00:00:00Z", "2022-01-02T00:00:00Z"},
+
+		// Either of the day of month or the day of week.
+		{"0 0 15 * 5L", "", false, "2022-01-01T00:00:00Z", "2022-01-15T00:00:00Z"},
+		{"0 0 15 * 5L", "", false, "2022-01-15T00:00:00Z", "2022-01-28T00:00:00Z"},
+		{"0 0 L * 0", "", false, "2022-01-01T00:00:00Z", "2022-01-02T00:00:00Z"},
+		{"0 0 L,15 * *", "", false, "2022-01-16T00:00:00Z", "2022-01-31T00:00:00Z"},
+		{"0 0 1-3,LW * *", "", false, "2022-04-04T00:00:00Z", "2022-04-29T00:00:00Z"},
+
+		// Timezone.
+		{"0 0 L * *", "Asia/Tokyo", false, "2022-01-30T00:00:00Z", "2022-01-30T15:00:00Z"},
+		{"0 0 L * *", "America/New_York", false, "2022-01-30T00:00:00Z", "2022-01-31T05:00:00Z"},
+		{"0 23 L * *", "Asia/Tokyo", false, "2022-02-28T00:00:00Z", "2022-02-28T14:00:00Z"},
+		{"0 9 * * 1#1", "Asia/Tokyo", false, "2022-01-02T23:00:00Z", "2022-01-03T00:00:00Z"},
+
+		// Seconds field.
+		{"30 0 0 L * *", "", true, "2022-01-15T00:00:00Z", "2022-01-31T00:00:30Z"},
+		{"*/20 0 0 L * *", "", true, "2022-01-31T00:00:00Z", "2022-01-31T00:00:20Z"},
+
+		// Multiple activations in a day.
+		{"*/30 * L * *", "", false, "2022-01-31T10:10:00Z", "2022-01-31T10:30:00Z"},
+		{"*/30 * L * *", "", false, "2022-01-31T23:30:00Z", "2022-02-28T00:00:00Z"},
+
+		// Never matches.
+		{"0 0 30W 2 *", "", false, "2022-01-01T00:00:00Z", ""},
+
+		// Standard specs are also supported.
+		{"0 0 1 * *", "", false, "2022-01-15T00:00:00Z", "2022-02-01T00:00:00Z"},
+		{"@monthly", "", false, "2022-01-15T00:00:00Z", "2022-02-01T00:00:00Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s/%s", tt.Spec, tt.TZ, tt.From), func(t *testing.T) {
+			s, err := ParseSchedule(tt.Spec, tt.TZ, tt.WithSeconds)
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+
+			from, err := time.Parse(time.RFC3339, tt.From)
+			if err != nil {
+				t.Fatalf("failed to parse from time: %s", err)
+			}
+
+			next := s.Next(from)
+
+			if tt.Next == "" {
+				if !next.IsZero() {
+					t.Fatalf("expected never but got %s", next)
+				}
+				return
+			}
+
+			expected, err := time.Parse(time.RFC3339, tt.Next)
+			if err != nil {
+				t.Fatalf("failed to parse expected time: %s", err)
+			}
+			if !next.Equal(expected) {
+				t.Errorf("unexpected next time\nexpected: %s\n but got: %s", expected, next.UTC())
+			}
+		})
+	}
+}
+
+func TestParseSchedule_invalid(t *testing.T) {
+	tests := []string{
+		"0 0 L-0 * *",
+		"0 0 L-31 * *",
+		"0 0 0W * *",
+		"0 0 32W * *",
+		"0 0 W * *",
+		"0 0 LX * *",
+		"0 0 * * L",
+		"0 0 * * 8L",
+		"0 0 * * 1#0",
+		"0 0 * * 1#6",
+		"0 0 * * #2",
+		"0 0 * * 1-9#2",
+		"0 0 0-5,L * *",
+	}
+
+	for _, tt := range tests {
+		t.Run(tt, func(t *testing.T) {
+			if _, err := ParseSchedule(tt, "", false); !errors.Is(err, ErrInvalidDaySpec) {
+				t.Errorf("expected ErrInvalidDaySpec but got %v", err)
+			}
+		})
+	}
+}
+
+func TestParseTask_extendedSchedule(t *testing.T) {
+	task, err := ParseTask("test", "0 0 L * *  echo hello", Environ{"CRON_TZ=Asia/Tokyo"})
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+
+	if task.String() != "0 0 L * *  echo hello" {
+		t.Errorf("unexpected string: %q", task.String())
+	}
+
+	from := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	expected := time.Date(2024, 2, 29, 0, 0, 0, 0, time.FixedZone("JST", 9*60*60))
+	if next := task.Schedule.Next(from); !next.Equal(expected) {
+		t.Errorf("unexpected next time\nexpected: %s\n but got: %s", expected, next)
+	}
+}
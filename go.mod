@@ -8,6 +8,8 @@ require (
 	github.com/prometheus/client_golang v1.12.1
 	github.com/robfig/cron/v3 v3.0.1
 	go.uber.org/zap v1.21.0
+	golang.org/x/sys v0.0.0-20220406163625-3f8b81556e12
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -20,6 +22,5 @@ require (
 	github.com/prometheus/procfs v0.7.3 // indirect
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.8.0 // indirect
-	golang.org/x/sys v0.0.0-20220406163625-3f8b81556e12 // indirect
 	google.golang.org/protobuf v1.28.0 // indirect
 )
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// GlobalGroupName is the name of the ConcurrencyGroup that all tasks belong to.
+const GlobalGroupName = "*"
+
+// ConcurrencyGroup limits the number of tasks running at the same time.
+// The tasks waiting for a slot start in the order of arrival.
+type ConcurrencyGroup struct {
+	sync.Mutex
+
+	Name string
+
+	limit   int
+	running int
+	queue   []chan struct{}
+}
+
+// GroupStatus is a snapshot of a ConcurrencyGroup.
+type GroupStatus struct {
+	Name    string
+	Limit   int
+	Running int
+	Waiting int
+}
+
+// SetLimit sets the maximum number of running tasks in the group.
+// Zero or negative value means unlimited.
+func (g *ConcurrencyGroup) SetLimit(limit int) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.limit = limit
+	g.dispatch()
+}
+
+// Acquire waits for a free slot in the group.
+// It returns false if the context is canceled before got a slot.
+func (g *ConcurrencyGroup) Acquire(ctx context.Context) bool {
+	g.Lock()
+	if len(g.queue) == 0 && g.hasFreeSlot() {
+		g.running++
+		g.Unlock()
+		return true
+	}
+	ch := make(chan struct{})
+	g.queue = append(g.queue, ch)
+	g.Unlock()
+
+	select {
+	case <-ch:
+		return true
+	case <-ctx.Done():
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	for i, c := range g.queue {
+		if c == ch {
+			g.queue = append(g.queue[:i], g.queue[i+1:]...)
+			return false
+		}
+	}
+
+	// The slot was given at the same time as canceled. Give it to the next one.
+	g.running--
+	g.dispatch()
+	return false
+}
+
+// Release releases a slot that acquired via Acquire.
+func (g *ConcurrencyGroup) Release() {
+	g.Lock()
+	defer g.Unlock()
+
+	g.running--
+	g.dispatch()
+}
+
+// Status returns the current status of the group.
+func (g *ConcurrencyGroup) Status() GroupStatus {
+	g.Lock()
+	defer g.Unlock()
+
+	return GroupStatus{
+		Name:    g.Name,
+		Limit:   g.limit,
+		Running: g.running,
+		Waiting: len(g.queue),
+	}
+}
+
+func (g *ConcurrencyGroup) hasFreeSlot() bool {
+	return g.limit <= 0 || g.running < g.limit
+}
+
+// dispatch gives free slots to waiting tasks.
+func (g *ConcurrencyGroup) dispatch() {
+	for len(g.queue) > 0 && g.hasFreeSlot() {
+		close(g.queue[0])
+		g.queue = g.queue[1:]
+		g.running++
+	}
+}
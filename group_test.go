@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyGroup(t *testing.T) {
+	g := &ConcurrencyGroup{Name: "test"}
+	g.SetLimit(2)
+
+	ctx := context.Background()
+
+	if !g.Acquire(ctx) || !g.Acquire(ctx) {
+		t.Fatalf("failed to acquire free slots")
+	}
+
+	acquired := make(chan int)
+	for i := 0; i < 3; i++ {
+		i := i
+		go func() {
+			if g.Acquire(ctx) {
+				acquired <- i
+			}
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if s := g.Status(); s.Running != 2 || s.Waiting != 3 {
+		t.Fatalf("unexpected status: %#v", s)
+	}
+
+	next := func() int {
+		select {
+		case i := <-acquired:
+			return i
+		case <-time.After(time.Second):
+			t.Fatalf("no task acquired a slot")
+			return -1
+		}
+	}
+
+	// Release slots one by one, so the waiting tasks should acquire slots in the order of arrival.
+	for i := 0; i < 2; i++ {
+		g.Release()
+		if x := next(); x != i {
+			t.Fatalf("expected task %d acquires a slot but got %d", i, x)
+		}
+		if s := g.Status(); s.Running != 2 || s.Waiting != 2-i {
+			t.Fatalf("unexpected status after release: %#v", s)
+		}
+	}
+
+	g.SetLimit(3)
+	if x := next(); x != 2 {
+		t.Fatalf("expected task 2 acquires a slot but got %d", x)
+	}
+	if s := g.Status(); s.Running != 3 || s.Waiting != 0 {
+		t.Fatalf("unexpected status after increase limit: %#v", s)
+	}
+}
+
+func TestConcurrencyGroup_cancel(t *testing.T) {
+	g := &ConcurrencyGroup{Name: "test"}
+	g.SetLimit(1)
+
+	if !g.Acquire(context.Background()) {
+		t.Fatalf("failed to acquire a free slot")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if g.Acquire(ctx) {
+		t.Fatalf("acquired a slot even though there is no free slot")
+	}
+
+	if s := g.Status(); s.Running != 1 || s.Waiting != 0 {
+		t.Fatalf("unexpected status: %#v", s)
+	}
+}
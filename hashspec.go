@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidHash = errors.New("invalid H expression")
+)
+
+// hashFieldRanges is the range of each field in the schedule spec for H.
+// The day of month is limited to 28 to run on every month.
+var hashFieldRanges = [5][2]int{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 28}, // day of month
+	{1, 12}, // month
+	{0, 6},  // day of week
+}
+
+// ResolveHashSpec replaces Jenkins style H in the schedule spec with numbers derived from the id.
+//
+// It supports H, H(min-max), H/step, and H(min-max)/step.
+// The same id always gets the same result.
+// The spec can have the seconds field as the first field.
+func ResolveHashSpec(spec string, id uint64) (string, error) {
+	fields := strings.Fields(spec)
+
+	ranges := hashFieldRanges[:]
+	switch len(fields) {
+	case len(hashFieldRanges):
+	case len(hashFieldRanges) + 1:
+		ranges = append([][2]int{{0, 59}}, ranges...)
+	default:
+		return spec, nil
+	}
+
+	for i, f := range fields {
+		if !strings.ContainsRune(f, 'H') {
+			continue
+		}
+
+		hash := mixHash(id, uint64(i))
+
+		var xs []string
+		for _, x := range strings.Split(f, ",") {
+			r, err := resolveHashExpr(x, ranges[i][0], ranges[i][1], hash)
+			if err != nil {
+				return "", err
+			}
+			xs = append(xs, r)
+		}
+		fields[i] = strings.Join(xs, ",")
+	}
+
+	return strings.Join(fields, " "), nil
+}
+
+// resolveHashExpr resolves one H expression in a field.
+func resolveHashExpr(expr string, min, max int, hash uint64) (string, error) {
+	if !strings.HasPrefix(expr, "H") {
+		return expr, nil
+	}
+	rest := expr[1:]
+
+	lo, hi := min, max
+	if strings.HasPrefix(rest, "(") {
+		end := strings.IndexRune(rest, ')')
+		if end < 0 {
+			return "", fmt.Errorf("%w: %q", ErrInvalidHash, expr)
+		}
+		var err error
+		lo, hi, err = parseHashRange(rest[1:end])
+		if err != nil || lo < min || hi > max || lo > hi {
+			return "", fmt.Errorf("%w: %q", ErrInvalidHash, expr)
+		}
+		rest = rest[end+1:]
+	}
+
+	if rest == "" {
+		return strconv.Itoa(lo + int(hash%uint64(hi-lo+1))), nil
+	}
+
+	if !strings.HasPrefix(rest, "/") {
+		return "", fmt.Errorf("%w: %q", ErrInvalidHash, expr)
+	}
+	step, err := strconv.Atoi(rest[1:])
+	if err != nil || step <= 0 {
+		return "", fmt.Errorf("%w: %q", ErrInvalidHash, expr)
+	}
+
+	width := step
+	if hi-lo+1 < width {
+		width = hi - lo + 1
+	}
+	start := lo + int(hash%uint64(width))
+
+	return fmt.Sprintf("%d-%d/%d", start, hi, step), nil
+}
+
+func parseHashRange(s string) (lo, hi int, err error) {
+	xs := strings.SplitN(s, "-", 2)
+	if len(xs) != 2 {
+		return 0, 0, ErrInvalidHash
+	}
+	if lo, err = strconv.Atoi(xs[0]); err != nil {
+		return 0, 0, err
+	}
+	if hi, err = strconv.Atoi(xs[1]); err != nil {
+		return 0, 0, err
+	}
+	return lo, hi, nil
+}
+
+// mixHash makes a well distributed hash from the id and the field index, using the finalizer of SplitMix64.
+func mixHash(id, index uint64) uint64 {
+	z := id + 0x9e3779b97f4a7c15*(index+1)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
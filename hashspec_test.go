@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestResolveHashSpec(t *testing.T) {
+	tests := []struct {
+		Input string
+		Check func(fields []string) bool
+	}{
+		{"* * * * *", func(fs []string) bool {
+			return strings.Join(fs, " ") == "* * * * *"
+		}},
+		{"H * * * *", func(fs []string) bool {
+			n, err := strconv.Atoi(fs[0])
+			return err == nil && 0 <= n && n <= 59 && fs[1] == "*"
+		}},
+		{"H H(0-5) * * *", func(fs []string) bool {
+			n, err := strconv.Atoi(fs[1])
+			return err == nil && 0 <= n && n <= 5
+		}},
+		{"H/15 * * * *", func(fs []string) bool {
+			xs := strings.Split(fs[0], "-")
+			n, err := strconv.Atoi(xs[0])
+			return err == nil && 0 <= n && n < 15 && xs[1] == "59/15"
+		}},
+		{"0 H(9-17)/4 * * *", func(fs []string) bool {
+			xs := strings.Split(fs[1], "-")
+			n, err := strconv.Atoi(xs[0])
+			return err == nil && 9 <= n && n < 13 && xs[1] == "17/4"
+		}},
+		{"0 0 H * H", func(fs []string) bool {
+			dom, err1 := strconv.Atoi(fs[2])
+			dow, err2 := strconv.Atoi(fs[4])
+			return err1 == nil && err2 == nil && 1 <= dom && dom <= 28 && 0 <= dow && dow <= 6
+		}},
+		{"H,30 * * * *", func(fs []string) bool {
+			xs := strings.Split(fs[0], ",")
+			return len(xs) == 2 && xs[1] == "30"
+		}},
+		{"H 0 H(0-5) * * *", func(fs []string) bool {
+			sec, err1 := strconv.Atoi(fs[0])
+			hour, err2 := strconv.Atoi(fs[2])
+			return err1 == nil && err2 == nil && 0 <= sec && sec <= 59 && fs[1] == "0" && 0 <= hour && hour <= 5
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Input, func(t *testing.T) {
+			for id := uint64(0); id < 100; id++ {
+				spec, err := ResolveHashSpec(tt.Input, id)
+				if err != nil {
+					t.Fatalf("failed to resolve: %s", err)
+				}
+
+				if !tt.Check(strings.Fields(spec)) {
+					t.Fatalf("unexpected result for id %d: %q", id, spec)
+				}
+
+				if again, _ := ResolveHashSpec(tt.Input, id); again != spec {
+					t.Fatalf("result is not stable: %q and %q", spec, again)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveHashSpec_spread(t *testing.T) {
+	founds := map[string]bool{}
+	for id := uint64(0); id < 100; id++ {
+		spec, _ := ResolveHashSpec("H * * * *", id)
+		founds[spec] = true
+	}
+	if len(founds) < 30 {
+		t.Errorf("too few variations: %d", len(founds))
+	}
+}
+
+func TestResolveHashSpec_invalid(t *testing.T) {
+	tests := []string{
+		"H(0-60) * * * *",
+		"H(5-1) * * * *",
+		"H(0-5 * * * *",
+		"H/0 * * * *",
+		"H/x * * * *",
+		"Hx * * * *",
+	}
+
+	for _, tt := range tests {
+		t.Run(tt, func(t *testing.T) {
+			if _, err := ResolveHashSpec(tt, 42); !errors.Is(err, ErrInvalidHash) {
+				t.Errorf("expected ErrInvalidHash but got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+var (
+	ErrLimitExceeded = errors.New("resource limit exceeded")
+)
+
+// ResourceLimit is a resource limit for a task.
+type ResourceLimit struct {
+	// Name is the name of resource: AS, CPU, NOFILE, or NPROC.
+	Name string
+
+	// Value is the limit. The unit is bytes for AS, seconds for CPU, and count for others.
+	Value uint64
+}
+
+// String returns the limit in the same format as crontab.
+func (l ResourceLimit) String() string {
+	switch l.Name {
+	case "AS":
+		return "LIMIT_AS=" + humanize.IBytes(l.Value)
+	case "CPU":
+		return "LIMIT_CPU=" + (time.Duration(l.Value) * time.Second).String()
+	default:
+		return fmt.Sprintf("LIMIT_%s=%d", l.Name, l.Value)
+	}
+}
+
+// ParseResourceLimits reads LIMIT_AS, LIMIT_CPU, LIMIT_NOFILE, and LIMIT_NPROC from the Environ.
+//
+// LIMIT_AS accepts size like 512MiB or 1G.
+// LIMIT_CPU accepts duration like 30s or 10m, or number of seconds.
+func ParseResourceLimits(env Environ) ([]ResourceLimit, error) {
+	var ls []ResourceLimit
+
+	if v := env.Get("LIMIT_AS", ""); v != "" {
+		n, err := humanize.ParseBytes(v)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("LIMIT_AS: invalid size: %q", v)
+		}
+		ls = append(ls, ResourceLimit{"AS", n})
+	}
+
+	if v := env.Get("LIMIT_CPU", ""); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < time.Second {
+				return nil, fmt.Errorf("LIMIT_CPU: invalid duration: %q", v)
+			}
+			n = uint64(d / time.Second)
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("LIMIT_CPU: invalid duration: %q", v)
+		}
+		ls = append(ls, ResourceLimit{"CPU", n})
+	}
+
+	for _, name := range []string{"NOFILE", "NPROC"} {
+		key := "LIMIT_" + name
+		if v := env.Get(key, ""); v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil || n == 0 {
+				return nil, fmt.Errorf("%s: invalid number: %q", key, v)
+			}
+			ls = append(ls, ResourceLimit{name, n})
+		}
+	}
+
+	return ls, nil
+}
+
+// encodeResourceLimits encodes limits to pass to the helper.
+func encodeResourceLimits(ls []ResourceLimit) string {
+	xs := make([]string, len(ls))
+	for i, l := range ls {
+		xs[i] = l.Name + "=" + strconv.FormatUint(l.Value, 10)
+	}
+	return strings.Join(xs, ",")
+}
+
+// decodeResourceLimits decodes the output of encodeResourceLimits.
+func decodeResourceLimits(s string) ([]ResourceLimit, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var ls []ResourceLimit
+	for _, x := range strings.Split(s, ",") {
+		kv := strings.SplitN(x, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid limit: %q", x)
+		}
+		n, err := strconv.ParseUint(kv[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit: %q", x)
+		}
+		ls = append(ls, ResourceLimit{kv[0], n})
+	}
+	return ls, nil
+}
+
+// findResourceLimit finds the limit of the resource.
+func findResourceLimit(ls []ResourceLimit, name string) (ResourceLimit, bool) {
+	for _, l := range ls {
+		if l.Name == name {
+			return l, true
+		}
+	}
+	return ResourceLimit{}, false
+}
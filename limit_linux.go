@@ -0,0 +1,103 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var rlimitResources = map[string]int{
+	"AS":     unix.RLIMIT_AS,
+	"CPU":    unix.RLIMIT_CPU,
+	"NOFILE": unix.RLIMIT_NOFILE,
+	"NPROC":  unix.RLIMIT_NPROC,
+}
+
+// SetResourceLimits makes exec.Cmd to run with the resource limits.
+//
+// Go can not set resource limits only for the child process, so the limits are set by the exec helper.
+// See also RunExecHelper.
+func SetResourceLimits(_ LoggerHolder, cmd *exec.Cmd, ls []ResourceLimit) error {
+	if len(ls) == 0 {
+		return nil
+	}
+	return useExecHelper(cmd, "-rlimit", encodeResourceLimits(ls))
+}
+
+// applyResourceLimits sets the resource limits to the current process.
+func applyResourceLimits(ls []ResourceLimit) error {
+	for _, l := range ls {
+		res, ok := rlimitResources[l.Name]
+		if !ok {
+			return fmt.Errorf("unknown resource: %s", l.Name)
+		}
+
+		var cur unix.Rlimit
+		if err := unix.Getrlimit(res, &cur); err != nil {
+			return fmt.Errorf("failed to get %s: %w", l, err)
+		}
+
+		lim := unix.Rlimit{Cur: l.Value, Max: l.Value}
+		if l.Name == "CPU" {
+			// Keep a margin to the hard limit, to send SIGXCPU before SIGKILL.
+			lim.Max = l.Value + 1
+		}
+		if lim.Max > cur.Max {
+			lim.Max = cur.Max
+		}
+		if lim.Cur > lim.Max {
+			lim.Cur = lim.Max
+		}
+
+		if err := unix.Setrlimit(res, &lim); err != nil {
+			return fmt.Errorf("failed to set %s: %w", l, err)
+		}
+	}
+	return nil
+}
+
+// CheckLimitViolation checks if the process was killed because of the resource limits.
+// It returns an error that wraps ErrLimitExceeded if so, otherwise it returns nil.
+func CheckLimitViolation(state *os.ProcessState, ls []ResourceLimit) error {
+	if state == nil || len(ls) == 0 {
+		return nil
+	}
+
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return nil
+	}
+
+	// The shell reports 128+n if a child of it was killed by signal n.
+	var sig syscall.Signal
+	switch {
+	case ws.Signaled():
+		sig = ws.Signal()
+	case ws.Exited() && ws.ExitStatus() > 128:
+		sig = syscall.Signal(ws.ExitStatus() - 128)
+	default:
+		return nil
+	}
+
+	if l, ok := findResourceLimit(ls, "CPU"); ok {
+		used := state.UserTime() + state.SystemTime()
+		if sig == syscall.SIGXCPU || (sig == syscall.SIGKILL && uint64(used.Seconds()) >= l.Value) {
+			return fmt.Errorf("%w: CPU time (%s), killed by %s", ErrLimitExceeded, l, unix.SignalName(sig))
+		}
+	}
+
+	if l, ok := findResourceLimit(ls, "AS"); ok {
+		switch sig {
+		case syscall.SIGSEGV, syscall.SIGABRT, syscall.SIGBUS:
+			return fmt.Errorf("%w: probably memory (%s), killed by %s", ErrLimitExceeded, l, unix.SignalName(sig))
+		}
+	}
+
+	return nil
+}
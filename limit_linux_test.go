@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestTask_Run_limits(t *testing.T) {
+	t.Run("NOFILE", func(t *testing.T) {
+		t.Parallel()
+
+		task, err := ParseTask("test", "@daily ulimit -n", Environ{"LIMIT_NOFILE=64"})
+		if err != nil {
+			t.Fatalf("failed to parse: %s", err)
+		}
+
+		r := &TestTaskReporter{Logger: zap.NewNop()}
+		if err := task.Run(context.Background(), r); err != nil {
+			t.Fatalf("failed to run: %s", err)
+		}
+
+		if out := strings.TrimSpace(r.Output.String()); out != "64" {
+			t.Errorf("unexpected output: %q", out)
+		}
+	})
+
+	t.Run("CPU", func(t *testing.T) {
+		t.Parallel()
+
+		task, err := ParseTask("test", "@daily while :; do :; done", Environ{"LIMIT_CPU=1"})
+		if err != nil {
+			t.Fatalf("failed to parse: %s", err)
+		}
+
+		r := &TestTaskReporter{Logger: zap.NewNop()}
+		err = task.Run(context.Background(), r)
+		if !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if !strings.Contains(err.Error(), "SIGXCPU") {
+			t.Errorf("unexpected error message: %s", err)
+		}
+	})
+}
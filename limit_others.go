@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+
+	"go.uber.org/zap"
+)
+
+// SetResourceLimits makes exec.Cmd to run with the resource limits.
+// Resource limits are supported only in Linux, so this function only shows a warning.
+func SetResourceLimits(l LoggerHolder, _ *exec.Cmd, ls []ResourceLimit) error {
+	if len(ls) > 0 {
+		l.L().Warn(
+			"resource limits are not supported in "+runtime.GOOS,
+			zap.String("limits", encodeResourceLimits(ls)),
+		)
+	}
+	return nil
+}
+
+// CheckLimitViolation checks if the process was killed because of the resource limits.
+// It always returns nil except Linux.
+func CheckLimitViolation(_ *os.ProcessState, _ []ResourceLimit) error {
+	return nil
+}
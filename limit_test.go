@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseResourceLimits(t *testing.T) {
+	tests := []struct {
+		Env    Environ
+		Limits []ResourceLimit
+		Error  bool
+	}{
+		{Environ{}, nil, false},
+		{Environ{"LIMIT_AS=512MiB"}, []ResourceLimit{{"AS", 512 * 1024 * 1024}}, false},
+		{Environ{"LIMIT_AS=1G"}, []ResourceLimit{{"AS", 1000 * 1000 * 1000}}, false},
+		{Environ{"LIMIT_CPU=90"}, []ResourceLimit{{"CPU", 90}}, false},
+		{Environ{"LIMIT_CPU=1m30s"}, []ResourceLimit{{"CPU", 90}}, false},
+		{Environ{"LIMIT_NOFILE=64", "LIMIT_NPROC=10"}, []ResourceLimit{{"NOFILE", 64}, {"NPROC", 10}}, false},
+		{Environ{"LIMIT_AS=huge"}, nil, true},
+		{Environ{"LIMIT_AS=0"}, nil, true},
+		{Environ{"LIMIT_CPU=500ms"}, nil, true},
+		{Environ{"LIMIT_CPU=-1"}, nil, true},
+		{Environ{"LIMIT_NOFILE=many"}, nil, true},
+		{Environ{"LIMIT_NPROC=0"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.Env, " "), func(t *testing.T) {
+			ls, err := ParseResourceLimits(tt.Env)
+			if tt.Error {
+				if err == nil {
+					t.Fatalf("expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+
+			if !reflect.DeepEqual(ls, tt.Limits) {
+				t.Errorf("unexpected limits\nexpected: %v\n but got: %v", tt.Limits, ls)
+			}
+
+			decoded, err := decodeResourceLimits(encodeResourceLimits(ls))
+			if err != nil {
+				t.Fatalf("failed to decode: %s", err)
+			}
+			if !reflect.DeepEqual(decoded, tt.Limits) {
+				t.Errorf("unexpected decoded limits\nexpected: %v\n but got: %v", tt.Limits, decoded)
+			}
+		})
+	}
+}
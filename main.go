@@ -9,7 +9,9 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"go.uber.org/zap"
@@ -21,6 +23,8 @@ var (
 	commit  = "unknown"
 
 	DefaultListen = ":8000"
+
+	DefaultShutdownTaskTimeout = 30 * time.Second
 )
 
 func prepareLogger(logStream zapcore.WriteSyncer, env Environ) *zap.Logger {
@@ -62,7 +66,50 @@ func startServer(ctx context.Context, logStream zapcore.WriteSyncer, env Environ
 		cancel()
 	}()
 
-	s := NewScheduler(ctx, sm)
+	stateDir := env.Get("CONCRON_STATE_DIR", DefaultStateDir)
+	statePath := filepath.Join(stateDir, "last-runs.json")
+	state, err := OpenStateStore(statePath)
+	if err != nil {
+		logger.Error("failed to load state. catching up missed runs is disabled", zap.String("path", statePath), zap.Error(err))
+		state = nil
+	}
+
+	grace, err := env.GetDuration("CONCRON_SHUTDOWN_GRACE", 0)
+	if err != nil {
+		logger.Error("invalid shutdown grace period", zap.Error(err))
+		return 2
+	}
+
+	shutdownTimeout, err := env.GetDuration("CONCRON_SHUTDOWN_TASK_TIMEOUT", DefaultShutdownTaskTimeout)
+	if err != nil {
+		logger.Error("invalid timeout for shutdown tasks", zap.Error(err))
+		return 2
+	}
+
+	// The scheduler doesn't use ctx, because tasks should not be canceled until the grace period has passed.
+	s := NewScheduler(context.Background(), sm, state)
+
+	maxParallel, err := env.GetInt("CONCRON_MAX_PARALLEL", 0)
+	if err != nil {
+		logger.Error("invalid maximum parallel", zap.Error(err))
+		return 2
+	}
+	s.SetMaxParallel(maxParallel)
+	s.SetCgroup(env.Get("CONCRON_CGROUP", ""))
+
+	// The API token should not be visible from tasks, so it is removed before loading any crontabs.
+	apiToken := env.Get("CONCRON_API_TOKEN", "")
+	os.Unsetenv("CONCRON_API_TOKEN")
+	env = append(Environ{}, env...)
+	env.Set("CONCRON_API_TOKEN=")
+
+	spoolPath := filepath.Join(stateDir, "at")
+	if q, err := OpenAtQueue(spoolPath, apiToken, env, s, sm); err != nil {
+		logger.Error("failed to open spool. one-shot jobs are disabled", zap.String("path", spoolPath), zap.Error(err))
+	} else {
+		sm.SetAtQueue(q)
+	}
+
 	NewCrontabCollector(ctx, s, sm, pathes).Register(ctx)
 
 	if envtab := env.Get("CONCRON_CRONTAB", ""); envtab != "" {
@@ -75,11 +122,17 @@ func startServer(ctx context.Context, logStream zapcore.WriteSyncer, env Environ
 		s.RegisterCrontab(ct, true)
 	}
 
+	// All crontabs are loaded here, so the records of the removed or edited tasks can be forgotten.
+	s.PruneState()
+
 	go s.Run()
 	<-ctx.Done()
 
 	sm.StartTerminating()
-	<-s.Stop()
+	logger.Info("terminating", zap.Duration("grace", grace), zap.Duration("shutdown_task_timeout", shutdownTimeout))
+	s.StopAccepting()
+	s.RunShutdownTasks(shutdownTimeout)
+	s.Shutdown(grace)
 
 	ctx2, cancel2 := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel2()
@@ -101,12 +154,46 @@ func init() {
 		fmt.Println("Environment Variables:")
 		fmt.Println("  CONCRON_PATH        List of path to crontab files. (default: " + DefaultPath + ")")
 		fmt.Println("  CONCRON_LISTEN      Listen address of dashboard and metrics. (default: " + DefaultListen + ")")
+		fmt.Println("  CONCRON_CGROUP      Cgroup v2 directory to make a cgroup for each task run. Linux only.")
 		fmt.Println("  CONCRON_LOGLEVEL    Log level. debug, info, warn, error, or fatal. (default: info)")
+		fmt.Println("  CONCRON_MAX_PARALLEL Maximum number of tasks running at the same time. (default: no limit)")
+		fmt.Println("  CONCRON_SHUTDOWN_GRACE Time to wait for running tasks on shutdown. (default: 0s)")
+		fmt.Println("  CONCRON_SHUTDOWN_TASK_TIMEOUT Maximum execution time of @shutdown tasks. (default: " + DefaultShutdownTaskTimeout.String() + ")")
+		fmt.Println("  CONCRON_STATE_DIR   Directory to store the state of Concron. (default: " + DefaultStateDir + ")")
+		fmt.Println("  CONCRON_API_TOKEN   Bearer token to use the HTTP API for one-shot jobs. (default: API disabled)")
 		fmt.Println("  CRON_TZ             Timezone for scheduling.")
+		fmt.Println("  DST_POLICY          How to run tasks on daylight saving time changes. default or vixie. (default: default)")
+		fmt.Println("  SCHEDULE_SECONDS    Use six fields schedule spec that includes seconds. (default: no)")
 		fmt.Println("  SHELL               Path to shell to execute command. (default: " + DefaultShell + ")")
 		fmt.Println("  SHELL_OPTS          Path to shell to execute command. (default: " + DefaultShellOpts + ")")
 		fmt.Println("  PARSE_COMMAND       Parse command before pass to shell. (default: no)")
+		fmt.Println("  EXPAND_ENV          Expand variables like ${VAR} in the following lines. yes, no, or strict. (default: no)")
+		fmt.Println("  WORKDIR             Working directory of tasks. (default: home directory of the user)")
 		fmt.Println("  ENABLE_USER_COLUMN  Parse and use user column in the crontab file. (default: no)")
+		fmt.Println("  NAME                Name of the task, to refer from AFTER or AFTER_FAILURE.")
+		fmt.Println("  AFTER               Run the @after task when the named task succeeded.")
+		fmt.Println("  AFTER_FAILURE       Run the @after task when the named task failed.")
+		fmt.Println("  CONCURRENCY_POLICY  What to do if the previous run is still running. allow, forbid, queue, or replace. (default: allow)")
+		fmt.Println("  TIMEOUT             Maximum execution time of a task, like 30m. (default: no limit)")
+		fmt.Println("  KILL_GRACE          Time to wait between SIGTERM and SIGKILL. (default: " + DefaultKillGrace.String() + ")")
+		fmt.Println("  RANDOM_DELAY        Maximum random delay before starting a task, like 15m. (default: no delay)")
+		fmt.Println("  RANDOM_DELAY_STABLE Use the same delay on every run of a task. (default: no)")
+		fmt.Println("  SKIP_CALENDAR       Path to a calendar file of blackout windows that tasks should not run in.")
+		fmt.Println("  CONCURRENCY_GROUP   Name of the group to limit the number of running tasks.")
+		fmt.Println("  CONCURRENCY_LIMIT   Maximum number of running tasks in the CONCURRENCY_GROUP. (default: 1)")
+		fmt.Println("  CATCH_UP            Run missed task after restart. yes, no, or maximum age like 12h. (default: no)")
+		fmt.Println("  RETRY_COUNT         How many times to retry a failed task. (default: 0)")
+		fmt.Println("  RETRY_DELAY         Delay before the first retry. (default: " + DefaultRetryDelay.String() + ")")
+		fmt.Println("  RETRY_BACKOFF       Multiplier of the delay for each retry. (default: " + strconv.FormatFloat(DefaultRetryBackoff, 'g', -1, 64) + ")")
+		fmt.Println("  LIMIT_AS            Maximum address space of each process, like 1GiB. Linux only. (default: no limit)")
+		fmt.Println("  LIMIT_CPU           Maximum CPU time of each process, like 10m. Linux only. (default: no limit)")
+		fmt.Println("  LIMIT_NOFILE        Maximum number of open files of each process. Linux only. (default: no limit)")
+		fmt.Println("  LIMIT_NPROC         Maximum number of processes of the user. Linux only. (default: no limit)")
+		fmt.Println("  NICE                Nice value of a task, from -20 to 19. Linux only.")
+		fmt.Println("  IONICE_CLASS        I/O scheduling class of a task. realtime, best-effort, or idle. Linux only.")
+		fmt.Println("  IONICE_LEVEL        I/O scheduling priority in the IONICE_CLASS, from 0 to 7. Linux only. (default: 4)")
+		fmt.Println("  MEMORY_MAX          Maximum memory usage of a task, like 1GiB. Requires CONCRON_CGROUP. (default: no limit)")
+		fmt.Println("  CPU_MAX             Maximum number of CPUs of a task, like 0.5. Requires CONCRON_CGROUP. (default: no limit)")
 	}
 }
 
@@ -140,7 +227,11 @@ func runHealthCheck(logStream zapcore.WriteSyncer, env Environ) (exitCode int) {
 }
 
 func main() {
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	if len(os.Args) > 1 && os.Args[1] == ExecHelperArg {
+		os.Exit(RunExecHelper(os.Args[2:]))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	showHelp := flag.Bool("h", false, "Show help and exit.")
@@ -11,6 +11,15 @@ import (
 	"time"
 )
 
+func TestMain(m *testing.M) {
+	// Some tasks execute the test binary itself as the exec helper.
+	if len(os.Args) > 1 && os.Args[1] == ExecHelperArg {
+		os.Exit(RunExecHelper(os.Args[2:]))
+	}
+
+	os.Exit(m.Run())
+}
+
 func Test_reboot(t *testing.T) {
 	timeout := 100 * time.Millisecond
 	if runtime.GOOS == "windows" {
@@ -124,3 +133,31 @@ func Test_CONCRON_CRONTAB(t *testing.T) {
 		t.Errorf("unexpected content of output\nexpected: %q\n but got: %q", expect, string(bs))
 	}
 }
+
+func Test_CONCRON_CRONTAB_apiToken(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test uses POSIX shell")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	dir := t.TempDir()
+	startServer(ctx, TestLogStream{t}, Environ{
+		"CONCRON_LOGLEVEL=debug",
+		"CONCRON_LISTEN=localhost:0",
+		"CONCRON_PATH=" + filepath.Join(dir, "crontab"),
+		"CONCRON_STATE_DIR=" + dir,
+		"CONCRON_TEMP_DIR=" + dir,
+		"CONCRON_API_TOKEN=secret-token",
+		`CONCRON_CRONTAB=@reboot echo "[$CONCRON_API_TOKEN]" > $CONCRON_TEMP_DIR/token`,
+	})
+
+	bs, err := os.ReadFile(filepath.Join(dir, "token"))
+	if err != nil {
+		t.Fatalf("failed to read output: %s", err)
+	}
+	if string(bs) != "[]\n" {
+		t.Errorf("the API token is visible from the task: %q", string(bs))
+	}
+}
@@ -3,4 +3,7 @@
 
 package main
 
-const DefaultPath = "/etc/crontab:/etc/cron.d"
+const (
+	DefaultPath     = "/etc/crontab:/etc/cron.d"
+	DefaultStateDir = "/var/lib/concron"
+)
@@ -9,7 +9,10 @@ import (
 	"strings"
 )
 
-var DefaultPath = `C:\crontab;C:\cron.d`
+var (
+	DefaultPath     = `C:\crontab;C:\cron.d`
+	DefaultStateDir = `C:\ProgramData\concron`
+)
 
 func init() {
 	u, err := user.Current()
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidNice    = errors.New("NICE must be an integer between -20 and 19")
+	ErrInvalidIOLevel = errors.New("IONICE_LEVEL must be an integer between 0 and 7")
+)
+
+// IOClass is the I/O scheduling class of the task.
+type IOClass int
+
+const (
+	IOClassNone       IOClass = 0
+	IOClassRealtime   IOClass = 1
+	IOClassBestEffort IOClass = 2
+	IOClassIdle       IOClass = 3
+)
+
+// ParseIOClass parses IONICE_CLASS.
+// It accepts both of the name and the number as same as ionice(1).
+func ParseIOClass(s string) (IOClass, error) {
+	switch strings.ToLower(s) {
+	case "", "none", "0":
+		return IOClassNone, nil
+	case "realtime", "1":
+		return IOClassRealtime, nil
+	case "best-effort", "2":
+		return IOClassBestEffort, nil
+	case "idle", "3":
+		return IOClassIdle, nil
+	default:
+		return IOClassNone, fmt.Errorf("IONICE_CLASS: unknown class: %q", s)
+	}
+}
+
+func (c IOClass) String() string {
+	switch c {
+	case IOClassRealtime:
+		return "realtime"
+	case IOClassBestEffort:
+		return "best-effort"
+	case IOClassIdle:
+		return "idle"
+	default:
+		return "none"
+	}
+}
+
+// Priority is the CPU and I/O scheduling priority of the task.
+type Priority struct {
+	// Nice is the nice value of the task. It is used only if SetNice is true.
+	Nice    int
+	SetNice bool
+
+	// IOClass is the I/O scheduling class. IOClassNone means not to change.
+	IOClass IOClass
+
+	// IOLevel is the priority in the IOClass, from 0 (highest) to 7 (lowest).
+	IOLevel int
+}
+
+// ParsePriority reads NICE, IONICE_CLASS, and IONICE_LEVEL from the Environ.
+func ParsePriority(env Environ) (p Priority, err error) {
+	if v := env.Get("NICE", ""); v != "" {
+		p.Nice, err = strconv.Atoi(v)
+		if err != nil || p.Nice < -20 || p.Nice > 19 {
+			return Priority{}, ErrInvalidNice
+		}
+		p.SetNice = true
+	}
+
+	p.IOClass, err = ParseIOClass(env.Get("IONICE_CLASS", ""))
+	if err != nil {
+		return Priority{}, err
+	}
+
+	p.IOLevel, err = env.GetInt("IONICE_LEVEL", 4)
+	if err != nil || p.IOLevel < 0 || p.IOLevel > 7 {
+		return Priority{}, ErrInvalidIOLevel
+	}
+	if env.Get("IONICE_LEVEL", "") != "" && (p.IOClass == IOClassNone || p.IOClass == IOClassIdle) {
+		return Priority{}, fmt.Errorf("IONICE_LEVEL: can not be used with IONICE_CLASS=%s", p.IOClass)
+	}
+
+	return p, nil
+}
+
+// IsDefault checks if the Priority does not change anything.
+func (p Priority) IsDefault() bool {
+	return !p.SetNice && p.IOClass == IOClassNone
+}
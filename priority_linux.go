@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// SetPriority makes exec.Cmd to run with the priority.
+// The priority is set by the exec helper, to apply it only to the child process. See also RunExecHelper.
+func SetPriority(_ LoggerHolder, cmd *exec.Cmd, p Priority) error {
+	var opts []string
+	if p.SetNice {
+		opts = append(opts, "-nice", strconv.Itoa(p.Nice))
+	}
+	if p.IOClass != IOClassNone {
+		opts = append(opts, "-ionice", fmt.Sprintf("%d:%d", p.IOClass, p.IOLevel))
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+	return useExecHelper(cmd, opts...)
+}
+
+// applyNice sets the nice value of the current process.
+func applyNice(nice int) error {
+	if err := unix.Setpriority(unix.PRIO_PROCESS, 0, nice); err != nil {
+		return fmt.Errorf("failed to set NICE=%d: %w", nice, err)
+	}
+	return nil
+}
+
+// applyIONice sets the I/O scheduling class and level of the current process.
+// The s is "class:level" in numbers.
+func applyIONice(s string) error {
+	xs := strings.SplitN(s, ":", 2)
+	if len(xs) != 2 {
+		return fmt.Errorf("invalid I/O priority: %q", s)
+	}
+	class, err := strconv.Atoi(xs[0])
+	if err != nil {
+		return fmt.Errorf("invalid I/O priority: %q", s)
+	}
+	level, err := strconv.Atoi(xs[1])
+	if err != nil {
+		return fmt.Errorf("invalid I/O priority: %q", s)
+	}
+
+	prio := class<<ioprioClassShift | level
+	if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio)); errno != 0 {
+		return fmt.Errorf("failed to set IONICE_CLASS=%s: %w", IOClass(class), errno)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestTask_Run_priority(t *testing.T) {
+	tests := []struct {
+		Command string
+		Env     Environ
+		Output  string
+	}{
+		{"nice", Environ{"NICE=7"}, "7"},
+		{"ionice", Environ{"IONICE_CLASS=idle"}, "idle"},
+		{"ionice", Environ{"IONICE_CLASS=best-effort", "IONICE_LEVEL=6"}, "best-effort: prio 6"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(strings.Join(tt.Env, " "), func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := exec.LookPath(tt.Command); err != nil {
+				t.Skipf("%s command is not available", tt.Command)
+			}
+
+			task, err := ParseTask("test", "@daily "+tt.Command, tt.Env)
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+
+			r := &TestTaskReporter{Logger: zap.NewNop()}
+			if err := task.Run(context.Background(), r); err != nil {
+				t.Fatalf("failed to run: %s\n%s", err, r.Output.String())
+			}
+
+			if out := strings.TrimSpace(r.Output.String()); out != tt.Output {
+				t.Errorf("unexpected output\nexpected: %q\n but got: %q", tt.Output, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os/exec"
+	"runtime"
+)
+
+// SetPriority makes exec.Cmd to run with the priority.
+// Priority is supported only in Linux, so this function only shows a warning.
+func SetPriority(l LoggerHolder, _ *exec.Cmd, p Priority) error {
+	if !p.IsDefault() {
+		l.L().Warn("NICE and IONICE_CLASS are not supported in " + runtime.GOOS)
+	}
+	return nil
+}
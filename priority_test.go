@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePriority(t *testing.T) {
+	tests := []struct {
+		Env      Environ
+		Priority Priority
+		Error    bool
+	}{
+		{Environ{}, Priority{IOLevel: 4}, false},
+		{Environ{"NICE=10"}, Priority{Nice: 10, SetNice: true, IOLevel: 4}, false},
+		{Environ{"NICE=-20"}, Priority{Nice: -20, SetNice: true, IOLevel: 4}, false},
+		{Environ{"NICE=0"}, Priority{Nice: 0, SetNice: true, IOLevel: 4}, false},
+		{Environ{"IONICE_CLASS=idle"}, Priority{IOClass: IOClassIdle, IOLevel: 4}, false},
+		{Environ{"IONICE_CLASS=best-effort", "IONICE_LEVEL=7"}, Priority{IOClass: IOClassBestEffort, IOLevel: 7}, false},
+		{Environ{"IONICE_CLASS=1", "IONICE_LEVEL=0"}, Priority{IOClass: IOClassRealtime, IOLevel: 0}, false},
+		{Environ{"NICE=20"}, Priority{}, true},
+		{Environ{"NICE=-21"}, Priority{}, true},
+		{Environ{"NICE=low"}, Priority{}, true},
+		{Environ{"IONICE_CLASS=slow"}, Priority{}, true},
+		{Environ{"IONICE_CLASS=best-effort", "IONICE_LEVEL=8"}, Priority{}, true},
+		{Environ{"IONICE_CLASS=idle", "IONICE_LEVEL=1"}, Priority{}, true},
+		{Environ{"IONICE_LEVEL=1"}, Priority{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.Env, " "), func(t *testing.T) {
+			p, err := ParsePriority(tt.Env)
+			if tt.Error {
+				if err == nil {
+					t.Fatalf("expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+
+			if p != tt.Priority {
+				t.Errorf("unexpected priority\nexpected: %+v\n but got: %+v", tt.Priority, p)
+			}
+		})
+	}
+}
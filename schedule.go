@@ -2,25 +2,132 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/robfig/cron/v3"
 	"go.uber.org/zap"
 )
 
+var (
+	ErrInvalidPolicy = errors.New("invalid concurrency policy")
+)
+
+// ConcurrencyPolicy is a policy to decide what to do when the previous run of the same task is still running.
+type ConcurrencyPolicy uint8
+
+const (
+	// PolicyAllow runs the new run in parallel with the previous one.
+	PolicyAllow ConcurrencyPolicy = iota
+
+	// PolicyForbid skips the new run.
+	PolicyForbid
+
+	// PolicyQueue waits for the previous run to finish before starting the new run.
+	PolicyQueue
+
+	// PolicyReplace cancels the previous run and starts the new run.
+	PolicyReplace
+)
+
+// ParseConcurrencyPolicy parses a value of CONCURRENCY_POLICY.
+func ParseConcurrencyPolicy(s string) (ConcurrencyPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "allow":
+		return PolicyAllow, nil
+	case "forbid":
+		return PolicyForbid, nil
+	case "queue":
+		return PolicyQueue, nil
+	case "replace":
+		return PolicyReplace, nil
+	default:
+		return PolicyAllow, fmt.Errorf("%w: %q", ErrInvalidPolicy, s)
+	}
+}
+
+func (p ConcurrencyPolicy) String() string {
+	switch p {
+	case PolicyAllow:
+		return "allow"
+	case PolicyForbid:
+		return "forbid"
+	case PolicyQueue:
+		return "queue"
+	case PolicyReplace:
+		return "replace"
+	default:
+		return "unknown"
+	}
+}
+
+// pendingRun is a run that waiting for the previous run of the same task.
+type pendingRun struct {
+	start  chan bool
+	cancel context.CancelFunc
+}
+
+// taskRuns is the running state of a task.
+type taskRuns struct {
+	cancel  context.CancelFunc
+	pending []pendingRun
+}
+
 // Scheduler is a task scheduler.
 // This is a simple wrapper for cron.Cron
 type Scheduler struct {
-	ctx  context.Context
-	cron *cron.Cron
-	sm   *StatusMonitor
+	sync.Mutex
+
+	ctx           context.Context
+	cancel        context.CancelFunc
+	accepting     context.Context
+	stopAccepting context.CancelFunc
+	wg            sync.WaitGroup
+	active        map[int]Task
+	lastRunID     int
+
+	cron       *cron.Cron
+	sm         *StatusMonitor
+	state      *StateStore
+	cgroup     string
+	runs       map[uint64]*taskRuns
+	global     *ConcurrencyGroup
+	groups     map[string]*ConcurrencyGroup
+	declared   map[string]string
+	triggered  map[cron.EntryID]Task
+	shutdown   map[cron.EntryID]Task
+	shutdownID cron.EntryID
+	catchUps   map[cron.EntryID]uint64
 }
 
-func NewScheduler(ctx context.Context, sm *StatusMonitor) *Scheduler {
+// NewScheduler makes a new Scheduler.
+// The ctx is used for running tasks. Please use Shutdown instead of cancel the ctx, to stop tasks gracefully.
+// The state is used to catch up missed runs. It can be nil if catching up is not needed.
+func NewScheduler(ctx context.Context, sm *StatusMonitor, state *StateStore) *Scheduler {
+	ctx, cancel := context.WithCancel(ctx)
+	accepting, stopAccepting := context.WithCancel(ctx)
+
 	return &Scheduler{
-		ctx:  ctx,
-		cron: cron.New(cron.WithLogger((*CronLogger)(sm.L()))),
-		sm:   sm,
+		ctx:           ctx,
+		cancel:        cancel,
+		accepting:     accepting,
+		stopAccepting: stopAccepting,
+		active:        make(map[int]Task),
+		cron:          cron.New(cron.WithLogger((*CronLogger)(sm.L()))),
+		sm:            sm,
+		state:         state,
+		runs:          make(map[uint64]*taskRuns),
+		global:        &ConcurrencyGroup{Name: GlobalGroupName},
+		groups:        make(map[string]*ConcurrencyGroup),
+		declared:      make(map[string]string),
+		triggered:     make(map[cron.EntryID]Task),
+		shutdown:      make(map[cron.EntryID]Task),
+		catchUps:      make(map[cron.EntryID]uint64),
 	}
 }
 
@@ -30,13 +137,313 @@ func (s *Scheduler) RegisterFunc(schedule cron.Schedule, fn func()) cron.EntryID
 }
 
 // RegisterTask registers a task to the scheduler.
+// If the task is triggered by another task, it will run when the upstream task finished.
 func (s *Scheduler) RegisterTask(t Task) cron.EntryID {
-	return s.RegisterFunc(t.Schedule, func() {
-		t.Run(s.ctx, s.sm)
+	id := s.RegisterFunc(t.Schedule, func() {
+		if !s.suppressed(t, time.Now()) {
+			s.RunTask(t)
+		}
 	})
+
+	if t.IsTriggered() {
+		s.Lock()
+		s.triggered[id] = t
+		s.Unlock()
+	}
+
+	return id
+}
+
+// registerShutdownTask registers a @shutdown task to the scheduler.
+// The task runs when RunShutdownTasks is called.
+//
+// The task is not registered to cron. Its ID is negative, so that it never conflicts with the IDs of cron entries.
+func (s *Scheduler) registerShutdownTask(t Task) cron.EntryID {
+	s.Lock()
+	defer s.Unlock()
+
+	s.shutdownID--
+	s.shutdown[s.shutdownID] = t
+
+	return s.shutdownID
+}
+
+// trigger runs tasks that wait for the upstream task.
+func (s *Scheduler) trigger(upstream Task, err error) {
+	if upstream.Name == "" || s.accepting.Err() != nil {
+		return
+	}
+
+	var ts []Task
+
+	s.Lock()
+	for _, t := range s.triggered {
+		if t.Source != upstream.Source {
+			continue
+		}
+		if (err == nil && t.After == upstream.Name) || (err != nil && t.AfterFailure == upstream.Name) {
+			ts = append(ts, t)
+		}
+	}
+	s.Unlock()
+
+	for _, t := range ts {
+		if s.suppressed(t, time.Now()) {
+			continue
+		}
+		s.sm.Triggered(t, upstream, err)
+		go s.RunTask(t)
+	}
+}
+
+// suppressed checks if the run at now is in a blackout of SKIP_CALENDAR, and reports it if so.
+func (s *Scheduler) suppressed(t Task, now time.Time) bool {
+	until, ok := t.Calendar.Blackout(now)
+	if ok {
+		s.sm.Suppressed(t, until)
+	}
+	return ok
+}
+
+// RunTask runs a task following its ConcurrencyPolicy.
+// Then it waits for free slots in the ConcurrencyGroup of the task and the global group.
+// It does nothing if the scheduler is shutting down.
+func (s *Scheduler) RunTask(t Task) {
+	s.Lock()
+	if s.accepting.Err() != nil {
+		s.Unlock()
+		return
+	}
+	s.wg.Add(1)
+	s.Unlock()
+	defer s.wg.Done()
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	// waitCtx is canceled when this run is canceled, or when the scheduler starts shutting down.
+	waitCtx, waitCancel := context.WithCancel(ctx)
+	defer waitCancel()
+	go func() {
+		select {
+		case <-s.accepting.Done():
+			waitCancel()
+		case <-waitCtx.Done():
+		}
+	}()
+
+	if t.Policy != PolicyAllow {
+		if !s.acquire(t, cancel) {
+			return
+		}
+		defer s.release(t)
+	}
+
+	groups := []*ConcurrencyGroup{s.global}
+	if t.Group != "" {
+		groups = []*ConcurrencyGroup{s.group(t, false), s.global}
+	}
+	for _, g := range groups {
+		if !s.acquireGroup(waitCtx, t, g) {
+			return
+		}
+		defer s.releaseGroup(g)
+	}
+
+	if s.accepting.Err() != nil {
+		return
+	}
+
+	s.recordRun(t, time.Now())
+
+	s.Lock()
+	s.lastRunID++
+	runID := s.lastRunID
+	s.active[runID] = t
+	t.cgroupRoot = s.cgroup
+	s.Unlock()
+
+	err := t.Run(ctx, s.sm)
+
+	s.Lock()
+	delete(s.active, runID)
+	s.Unlock()
+
+	// The run canceled by CONCURRENCY_POLICY=replace or shutdown is neither success nor failure.
+	if ctx.Err() != nil {
+		return
+	}
+
+	s.trigger(t, err)
+}
+
+// SetMaxParallel sets the maximum number of tasks running at the same time.
+// Zero or negative value means unlimited.
+func (s *Scheduler) SetMaxParallel(limit int) {
+	s.global.SetLimit(limit)
+	s.sm.GroupChanged(s.global.Status())
+}
+
+// DefaultGroupLimit is the limit of a ConcurrencyGroup that no task declared CONCURRENCY_LIMIT.
+const DefaultGroupLimit = 1
+
+// SetCgroup sets the cgroup v2 directory to make a cgroup for each task run.
+// Empty string means that tasks run without cgroup.
+func (s *Scheduler) SetCgroup(root string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.cgroup = root
+}
+
+// group returns the ConcurrencyGroup of the task.
+//
+// The limit of the group is fixed by the first task that declares CONCURRENCY_LIMIT, and the other tasks can't change it.
+// If reload is true, the tasks from the same source that declared the limit can change it, to apply the edited crontab.
+func (s *Scheduler) group(t Task, reload bool) *ConcurrencyGroup {
+	s.Lock()
+	g, ok := s.groups[t.Group]
+	if !ok {
+		g = &ConcurrencyGroup{Name: t.Group}
+		g.SetLimit(DefaultGroupLimit)
+		s.groups[t.Group] = g
+	}
+
+	source, declared := s.declared[t.Group]
+	update := t.GroupLimit > 0 && (!declared || (reload && source == t.Source))
+	if update {
+		s.declared[t.Group] = t.Source
+	}
+	s.Unlock()
+
+	if update {
+		g.SetLimit(t.GroupLimit)
+	} else if reload && t.GroupLimit > 0 && t.GroupLimit != g.Status().Limit {
+		s.sm.L().Warn(
+			"ignore conflicting CONCURRENCY_LIMIT",
+			zap.String("group", t.Group),
+			zap.String("declared_by", source),
+			zap.Int("limit", g.Status().Limit),
+			zap.String("source", t.Source),
+			zap.Int("ignored_limit", t.GroupLimit),
+		)
+	}
+	return g
+}
+
+func (s *Scheduler) acquireGroup(ctx context.Context, t Task, g *ConcurrencyGroup) bool {
+	stime := time.Now()
+	ok := g.Acquire(ctx)
+	s.sm.GroupWaited(t, g.Name, time.Since(stime))
+	s.sm.GroupChanged(g.Status())
+	return ok
+}
+
+func (s *Scheduler) releaseGroup(g *ConcurrencyGroup) {
+	g.Release()
+	s.sm.GroupChanged(g.Status())
+}
+
+// acquire waits until the task can start.
+// It returns false if this run should not start.
+func (s *Scheduler) acquire(t Task, cancel context.CancelFunc) bool {
+	s.Lock()
+
+	r, ok := s.runs[t.ID]
+	if !ok {
+		s.runs[t.ID] = &taskRuns{cancel: cancel}
+		s.Unlock()
+		return true
+	}
+
+	action := OverlapQueued
+	switch t.Policy {
+	case PolicyForbid:
+		s.Unlock()
+		s.sm.Overlapped(t, OverlapSkipped)
+		return false
+	case PolicyReplace:
+		action = OverlapReplaced
+		r.cancel()
+		for _, p := range r.pending {
+			p.start <- false
+		}
+		r.pending = nil
+	}
+
+	p := pendingRun{start: make(chan bool, 1), cancel: cancel}
+	r.pending = append(r.pending, p)
+	s.Unlock()
+
+	s.sm.Overlapped(t, action)
+
+	if !<-p.start {
+		s.sm.Overlapped(t, OverlapSkipped)
+		return false
+	}
+	return true
+}
+
+// release reports the task has finished, and starts the next pending run if exists.
+func (s *Scheduler) release(t Task) {
+	s.Lock()
+	defer s.Unlock()
+
+	r := s.runs[t.ID]
+
+	if s.accepting.Err() != nil {
+		for _, p := range r.pending {
+			p.start <- false
+		}
+		r.pending = nil
+	}
+
+	if len(r.pending) == 0 {
+		delete(s.runs, t.ID)
+		return
+	}
+
+	p := r.pending[0]
+	r.pending = r.pending[1:]
+	r.cancel = p.cancel
+	p.start <- true
+}
+
+// recordRun records the run time of the task to the StateStore, if the task needs to catch up.
+// It should be called when the run actually starts, not when the run is skipped by ConcurrencyPolicy or shut down.
+func (s *Scheduler) recordRun(t Task, at time.Time) {
+	if s.state == nil || !t.CatchUp || t.IsReboot {
+		return
+	}
+
+	if err := s.state.Record(t.ID, at); err != nil {
+		s.sm.L().Error("failed to record run time", zap.String("path", s.state.Path), zap.Error(err))
+	}
+}
+
+// catchUp runs the task if it missed a run while Concron was down.
+func (s *Scheduler) catchUp(t Task) {
+	if s.state == nil || !t.CatchUp || t.IsReboot {
+		return
+	}
+
+	now := time.Now()
+
+	last, ok := s.state.Last(t.ID)
+	if !ok {
+		// This is the first time to see this task. Record now as the baseline to detect missed runs in the future.
+		s.recordRun(t, now)
+		return
+	}
+
+	if missed, ok := t.Missed(last, now); ok && !s.suppressed(t, now) {
+		s.sm.CaughtUp(t, missed)
+		go s.RunTask(t)
+	}
 }
 
 // RegisterCrontab registers tasks from a Crontab.
+// If runRebootTask is true, it also runs @reboot tasks and catches up missed runs.
 func (s *Scheduler) RegisterCrontab(c Crontab, runRebootTask bool) []cron.EntryID {
 	l := s.sm.L().With(zap.String("path", c.Path))
 	l.Debug("loading")
@@ -44,9 +451,14 @@ func (s *Scheduler) RegisterCrontab(c Crontab, runRebootTask bool) []cron.EntryI
 	var ids []cron.EntryID
 
 	for _, t := range c.Tasks {
+		if t.Group != "" {
+			s.group(t, true)
+		}
+
 		l.Debug(
 			"load",
 			zap.String("schedule", t.ScheduleSpec),
+			zap.String("resolved_schedule", t.ResolvedSpec),
 			zap.String("user", t.User),
 			zap.String("command", t.Command),
 			zap.String("stdin", t.Stdin),
@@ -54,10 +466,21 @@ func (s *Scheduler) RegisterCrontab(c Crontab, runRebootTask bool) []cron.EntryI
 
 		if t.IsReboot {
 			if runRebootTask {
-				go t.Run(s.ctx, s.sm)
+				go s.RunTask(t)
 			}
+		} else if t.IsShutdown {
+			ids = append(ids, s.registerShutdownTask(t))
 		} else {
-			ids = append(ids, s.RegisterTask(t))
+			if runRebootTask {
+				s.catchUp(t)
+			}
+			id := s.RegisterTask(t)
+			if t.CatchUp {
+				s.Lock()
+				s.catchUps[id] = t.ID
+				s.Unlock()
+			}
+			ids = append(ids, id)
 		}
 	}
 
@@ -65,8 +488,33 @@ func (s *Scheduler) RegisterCrontab(c Crontab, runRebootTask bool) []cron.EntryI
 }
 
 func (s *Scheduler) Unregister(id ...cron.EntryID) {
+	s.Lock()
+	defer s.Unlock()
+
 	for _, x := range id {
 		s.cron.Remove(x)
+		delete(s.triggered, x)
+		delete(s.shutdown, x)
+		delete(s.catchUps, x)
+	}
+}
+
+// PruneState removes the records of tasks that are no longer registered from the StateStore.
+// Please call it after all crontabs are loaded, otherwise the records of not yet loaded tasks are removed.
+func (s *Scheduler) PruneState() {
+	if s.state == nil {
+		return
+	}
+
+	s.Lock()
+	known := make(map[uint64]bool, len(s.catchUps))
+	for _, id := range s.catchUps {
+		known[id] = true
+	}
+	s.Unlock()
+
+	if err := s.state.Prune(known); err != nil {
+		s.sm.L().Error("failed to prune state", zap.String("path", s.state.Path), zap.Error(err))
 	}
 }
 
@@ -75,12 +523,109 @@ func (s *Scheduler) Run() {
 	s.cron.Run()
 }
 
-// Stop stops scheduler.
-// The result is a chan to await all tasks closed.
-func (s *Scheduler) Stop() <-chan struct{} {
-	return s.cron.Stop().Done()
+// StopAccepting stops starting new tasks, both of scheduled ones and triggered ones.
+// It doesn't wait for the running tasks. Please use Shutdown for that.
+func (s *Scheduler) StopAccepting() {
+	s.Lock()
+	s.stopAccepting()
+	s.Unlock()
+
+	s.cron.Stop()
 }
 
+// RunShutdownTasks runs all @shutdown tasks in parallel, and waits for them to finish.
+//
+// The tasks are canceled if they are still running after the timeout minus their KILL_GRACE.
+// That means the SIGKILL is sent within the timeout, and all tasks exit by the timeout.
+// If the KILL_GRACE is longer than the half of the timeout, it is shortened to the half.
+//
+// They ignore ConcurrencyPolicy and ConcurrencyGroup, because they run only once.
+// They run even after StopAccepting, so please call StopAccepting before this to not start scheduled tasks any more.
+// Please call it before Shutdown, because the tasks are canceled immediately after Shutdown.
+func (s *Scheduler) RunShutdownTasks(timeout time.Duration) {
+	s.Lock()
+	var ts []Task
+	for _, t := range s.shutdown {
+		t.cgroupRoot = s.cgroup
+		ts = append(ts, t)
+	}
+	s.Unlock()
+
+	var wg sync.WaitGroup
+	for _, t := range ts {
+		if t.KillGrace > timeout/2 {
+			t.KillGrace = timeout / 2
+		}
+
+		wg.Add(1)
+		go func(t Task) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(s.ctx, timeout-t.KillGrace)
+			defer cancel()
+
+			t.Run(ctx, s.sm)
+		}(t)
+	}
+	wg.Wait()
+}
+
+// Shutdown stops scheduler gracefully.
+//
+// It stops starting new tasks, and waits for running tasks to finish up to the grace period.
+// After the grace period, it cancels the remaining tasks, that means sending SIGTERM and then SIGKILL, and waits for them to exit.
+// The result is the tasks that had to be canceled.
+func (s *Scheduler) Shutdown(grace time.Duration) []Task {
+	s.StopAccepting()
+
+	// The tasks started by cron are waited by s.wg instead of the cron, because the cron can not cancel them after the grace period.
+	defer func() {
+		<-s.cron.Stop().Done()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+	}
+
+	s.Lock()
+	var killed []Task
+	for _, t := range s.active {
+		killed = append(killed, t)
+	}
+	s.Unlock()
+
+	for _, t := range killed {
+		s.sm.L().Warn(
+			"kill",
+			zap.String("source", t.Source),
+			zap.String("schedule", t.ScheduleSpec),
+			zap.String("user", t.User),
+			zap.String("command", t.Command),
+			zap.String("stdin", t.Stdin),
+			zap.Duration("grace", grace),
+		)
+	}
+
+	s.cancel()
+	<-done
+
+	return killed
+}
+
+// secondsParser is a parser for schedule specs with the seconds field, that used if SCHEDULE_SECONDS is enabled.
+var secondsParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
 // ReloadSchedule is a cron schedule for crontab checking.
 // This schedule runs on every minute.
 type ReloadSchedule struct{}
@@ -89,3 +634,69 @@ type ReloadSchedule struct{}
 func (s ReloadSchedule) Next(t time.Time) time.Time {
 	return t.Add(time.Duration(60-t.Second())*time.Second - time.Duration(t.Nanosecond())*time.Nanosecond)
 }
+
+// randomDelaySeed is a seed for DelayedSchedule that differs for each process.
+// It makes different delay on each container even if they have the same crontab.
+var randomDelaySeed = uint64(time.Now().UnixNano())
+
+// DelayedSchedule is a cron.Schedule that delays each activation of Schedule up to Max.
+//
+// The delay is pseudo-random but deterministic, so Next always returns the same time for the same input.
+// If PerRun is false, all activations have the same delay that derived from Seed.
+// Otherwise, each activation has different delay.
+type DelayedSchedule struct {
+	Schedule cron.Schedule
+	Max      time.Duration
+	Seed     uint64
+	PerRun   bool
+}
+
+// NewDelayedSchedule makes a new DelayedSchedule for the Task.
+func NewDelayedSchedule(t Task, max time.Duration, perRun bool) DelayedSchedule {
+	seed := t.ID
+	if perRun {
+		seed ^= randomDelaySeed
+	}
+	return DelayedSchedule{
+		Schedule: t.Schedule,
+		Max:      max,
+		Seed:     seed,
+		PerRun:   perRun,
+	}
+}
+
+// Delay returns the delay for the activation at the specified time.
+func (s DelayedSchedule) Delay(t time.Time) time.Duration {
+	if s.Max <= 0 {
+		return 0
+	}
+
+	h := crc64.New(hashTable)
+	binary.Write(h, binary.LittleEndian, s.Seed)
+	if s.PerRun {
+		binary.Write(h, binary.LittleEndian, t.Unix())
+	}
+	return time.Duration(h.Sum64() % uint64(s.Max))
+}
+
+// Next implements cron.Schedule.
+func (s DelayedSchedule) Next(t time.Time) time.Time {
+	base := s.Schedule.Next(t.Add(-s.Max))
+	for !base.IsZero() {
+		next := base.Add(s.Delay(base))
+		if next.After(t) {
+			return next
+		}
+		base = s.Schedule.Next(base)
+	}
+	return base
+}
+
+// AfterSchedule is a cron.Schedule for tasks that triggered by another task.
+// It never activates by itself.
+type AfterSchedule struct{}
+
+// Next implements cron.Schedule.
+func (s AfterSchedule) Next(t time.Time) time.Time {
+	return time.Time{}
+}
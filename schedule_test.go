@@ -1,9 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/robfig/cron/v3"
 )
 
 func TestReloadSchedule(t *testing.T) {
@@ -28,3 +38,585 @@ func TestReloadSchedule(t *testing.T) {
 		})
 	}
 }
+
+func TestParseConcurrencyPolicy(t *testing.T) {
+	tests := []struct {
+		Input  string
+		Output ConcurrencyPolicy
+		Error  bool
+	}{
+		{"", PolicyAllow, false},
+		{"allow", PolicyAllow, false},
+		{"Forbid", PolicyForbid, false},
+		{" queue ", PolicyQueue, false},
+		{"REPLACE", PolicyReplace, false},
+		{"skip", PolicyAllow, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Input, func(t *testing.T) {
+			p, err := ParseConcurrencyPolicy(tt.Input)
+			if tt.Error {
+				if !errors.Is(err, ErrInvalidPolicy) {
+					t.Fatalf("expected ErrInvalidPolicy but got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+			if p != tt.Output {
+				t.Errorf("expected %s but got %s", tt.Output, p)
+			}
+		})
+	}
+}
+
+func TestScheduler_RunTask(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test uses sleep command")
+	}
+
+	tests := []struct {
+		Policy   string
+		Outputs  string
+		Skipped  int
+		Replaced int
+	}{
+		{"allow", "aa", 0, 0},
+		{"forbid", "a", 1, 0},
+		{"queue", "aa", 0, 0},
+		{"replace", "a", 0, 1},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Policy, func(t *testing.T) {
+			t.Parallel()
+
+			out := filepath.Join(t.TempDir(), "out")
+
+			task, err := ParseTask("test", "@reboot sleep 0.2 && printf a >> "+out, Environ{"CONCURRENCY_POLICY=" + tt.Policy})
+			if err != nil {
+				t.Fatalf("failed to parse task: %s", err)
+			}
+
+			sm := NewStatusMonitor(NewTestLogger(t))
+			s := NewScheduler(context.Background(), sm, nil)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					s.RunTask(task)
+				}()
+				time.Sleep(50 * time.Millisecond)
+			}
+			wg.Wait()
+
+			bs, _ := os.ReadFile(out)
+			if string(bs) != tt.Outputs {
+				t.Errorf("unexpected output: expected %q but got %q", tt.Outputs, string(bs))
+			}
+
+			status := sm.task[task.ID]
+			if status.Skipped != tt.Skipped {
+				t.Errorf("unexpected skipped count: expected %d but got %d", tt.Skipped, status.Skipped)
+			}
+			if status.Replaced != tt.Replaced {
+				t.Errorf("unexpected replaced count: expected %d but got %d", tt.Replaced, status.Replaced)
+			}
+		})
+	}
+}
+
+func TestDelayedSchedule(t *testing.T) {
+	hourly, err := cron.ParseStandard("@hourly")
+	if err != nil {
+		t.Fatalf("failed to parse schedule: %s", err)
+	}
+
+	for _, perRun := range []bool{false, true} {
+		perRun := perRun
+		t.Run(fmt.Sprintf("perRun=%v", perRun), func(t *testing.T) {
+			s := DelayedSchedule{Schedule: hourly, Max: 30 * time.Minute, Seed: 42, PerRun: perRun}
+
+			now := time.Date(2021, 1, 2, 15, 0, 0, 0, time.UTC)
+			delays := map[time.Duration]bool{}
+			for i := 0; i < 24; i++ {
+				next := s.Next(now)
+				if next != s.Next(now) {
+					t.Fatalf("Next returns different time for the same input: %s", now)
+				}
+
+				base := next.Truncate(time.Hour)
+				if base != now.Truncate(time.Hour).Add(time.Hour) && base != now.Truncate(time.Hour) {
+					t.Fatalf("unexpected next time for %s: %s", now, next)
+				}
+				if d := next.Sub(base); d < 0 || d >= s.Max {
+					t.Fatalf("unexpected delay: %s", d)
+				}
+				delays[next.Sub(base)] = true
+
+				// No activation should be skipped even if Next called during the delay.
+				if mid := base.Add(next.Sub(base) / 2); mid.After(now) && s.Next(mid) != next {
+					t.Fatalf("activation at %s skipped when called at %s: got %s", next, mid, s.Next(mid))
+				}
+
+				now = next
+			}
+
+			if perRun && len(delays) == 1 {
+				t.Errorf("all delays are the same in per-run mode: %v", delays)
+			}
+			if !perRun && len(delays) != 1 {
+				t.Errorf("delays differ in stable mode: %v", delays)
+			}
+		})
+	}
+}
+
+func TestScheduler_catchUp(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test uses sh syntax")
+	}
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+
+	ct, err := ParseCrontab("test", strings.NewReader(strings.Join([]string{
+		"CATCH_UP=yes",
+		"@hourly printf missed >> " + out,
+		"CATCH_UP=no",
+		"@hourly printf not-catch-up >> " + out,
+	}, "\n")), Environ{})
+	if err != nil {
+		t.Fatalf("failed to parse crontab: %s", err)
+	}
+
+	state, err := OpenStateStore(filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatalf("failed to open state: %s", err)
+	}
+	for _, task := range ct.Tasks {
+		state.Record(task.ID, time.Now().Add(-2*time.Hour))
+	}
+
+	sm := NewStatusMonitor(NewTestLogger(t))
+	s := NewScheduler(context.Background(), sm, state)
+
+	// Not the first load, so nothing should run.
+	s.Unregister(s.RegisterCrontab(ct, false)...)
+	time.Sleep(100 * time.Millisecond)
+	if bs, _ := os.ReadFile(out); string(bs) != "" {
+		t.Fatalf("unexpected output: %q", string(bs))
+	}
+
+	s.Unregister(s.RegisterCrontab(ct, true)...)
+	time.Sleep(100 * time.Millisecond)
+	if bs, _ := os.ReadFile(out); string(bs) != "missed" {
+		t.Errorf("unexpected output: %q", string(bs))
+	}
+
+	if last, _ := state.Last(ct.Tasks[0].ID); time.Since(last) > time.Minute {
+		t.Errorf("run time is not recorded: %s", last)
+	}
+}
+
+func TestScheduler_catchUp_record(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test uses sh syntax")
+	}
+
+	dir := t.TempDir()
+
+	ct, err := ParseCrontab("test", strings.NewReader(strings.Join([]string{
+		"CATCH_UP=yes",
+		"CONCURRENCY_POLICY=forbid",
+		"@hourly sleep 0.3",
+		"@daily echo edited",
+	}, "\n")), Environ{})
+	if err != nil {
+		t.Fatalf("failed to parse crontab: %s", err)
+	}
+	task := ct.Tasks[0]
+
+	state, err := OpenStateStore(filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatalf("failed to open state: %s", err)
+	}
+	state.Record(12345, time.Now())
+
+	sm := NewStatusMonitor(NewTestLogger(t))
+	s := NewScheduler(context.Background(), sm, state)
+	defer s.Shutdown(0)
+
+	ids := s.RegisterCrontab(ct, true)
+
+	// The record of an unknown task, such as an edited line, should be removed.
+	s.PruneState()
+	if _, ok := state.Last(12345); ok {
+		t.Errorf("unknown task is not pruned")
+	}
+	for _, x := range ct.Tasks {
+		if _, ok := state.Last(x.ID); !ok {
+			t.Errorf("known task is pruned: %s", x)
+		}
+	}
+
+	go s.RunTask(task)
+	time.Sleep(100 * time.Millisecond)
+
+	// The second run is skipped by the policy, so it should not be recorded.
+	old := time.Now().Add(-time.Hour)
+	state.Record(task.ID, old)
+	s.RunTask(task)
+	if last, _ := state.Last(task.ID); !last.Equal(old) {
+		t.Errorf("skipped run is recorded: %s", last)
+	}
+
+	s.Unregister(ids...)
+	s.PruneState()
+	if _, ok := state.Last(task.ID); ok {
+		t.Errorf("unregistered task is not pruned")
+	}
+}
+
+func TestScheduler_RunTask_group(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test uses sh syntax")
+	}
+
+	tests := []struct {
+		Name        string
+		Env         Environ
+		MaxParallel int
+		Output      string
+	}{
+		{"unlimited", Environ{}, 0, "aabb"},
+		{"group", Environ{"CONCURRENCY_GROUP=test"}, 0, "abab"},
+		{"group-limit", Environ{"CONCURRENCY_GROUP=test", "CONCURRENCY_LIMIT=2"}, 0, "aabb"},
+		{"global", Environ{}, 1, "abab"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			t.Parallel()
+
+			out := filepath.Join(t.TempDir(), "out")
+
+			sm := NewStatusMonitor(NewTestLogger(t))
+			s := NewScheduler(context.Background(), sm, nil)
+			s.SetMaxParallel(tt.MaxParallel)
+
+			var wg sync.WaitGroup
+			for _, name := range []string{"x", "y"} {
+				task, err := ParseTask("test", "@reboot printf a >> "+out+"; sleep 0.1; printf b >> "+out+" # "+name, tt.Env)
+				if err != nil {
+					t.Fatalf("failed to parse task: %s", err)
+				}
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					s.RunTask(task)
+				}()
+				time.Sleep(20 * time.Millisecond)
+			}
+			wg.Wait()
+
+			if bs, _ := os.ReadFile(out); string(bs) != tt.Output {
+				t.Errorf("unexpected output: expected %q but got %q", tt.Output, string(bs))
+			}
+		})
+	}
+}
+
+func TestScheduler_group(t *testing.T) {
+	sm := NewStatusMonitor(NewTestLogger(t))
+	s := NewScheduler(context.Background(), sm, nil)
+
+	task := func(source string, env Environ) Task {
+		t.Helper()
+		task, err := ParseTask(source, "@daily echo hello", append(Environ{"CONCURRENCY_GROUP=test"}, env...))
+		if err != nil {
+			t.Fatalf("failed to parse task: %s", err)
+		}
+		return task
+	}
+
+	tests := []struct {
+		Name   string
+		Task   Task
+		Reload bool
+		Limit  int
+	}{
+		{"default", task("a", nil), false, DefaultGroupLimit},
+		{"declare", task("a", Environ{"CONCURRENCY_LIMIT=2"}), false, 2},
+		{"without-limit", task("a", nil), false, 2},
+		{"other-source", task("b", Environ{"CONCURRENCY_LIMIT=3"}), true, 2},
+		{"same-source-run", task("a", Environ{"CONCURRENCY_LIMIT=3"}), false, 2},
+		{"same-source-reload", task("a", Environ{"CONCURRENCY_LIMIT=3"}), true, 3},
+	}
+
+	for _, tt := range tests {
+		if l := s.group(tt.Task, tt.Reload).Status().Limit; l != tt.Limit {
+			t.Errorf("%s: expected limit %d but got %d", tt.Name, tt.Limit, l)
+		}
+	}
+}
+
+func TestScheduler_trigger(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test uses sh syntax")
+	}
+
+	out := filepath.Join(t.TempDir(), "out")
+
+	ct, err := ParseCrontab("test", strings.NewReader(strings.Join([]string{
+		"NAME=first",
+		"@reboot printf 1 >> " + out,
+		"NAME=second",
+		"AFTER=first",
+		"@after printf 2 >> " + out + "; exit 1",
+		"NAME=on-success",
+		"AFTER=second",
+		"@after printf x >> " + out,
+		"NAME=on-failure",
+		"AFTER=",
+		"AFTER_FAILURE=second",
+		"@after printf 3 >> " + out,
+	}, "\n")), Environ{})
+	if err != nil {
+		t.Fatalf("failed to parse crontab: %s", err)
+	}
+
+	sm := NewStatusMonitor(NewTestLogger(t))
+	s := NewScheduler(context.Background(), sm, nil)
+
+	ids := s.RegisterCrontab(ct, true)
+	time.Sleep(200 * time.Millisecond)
+
+	if bs, _ := os.ReadFile(out); string(bs) != "123" {
+		t.Errorf("unexpected output: %q", string(bs))
+	}
+
+	s.Unregister(ids...)
+	if len(s.triggered) != 0 {
+		t.Errorf("triggered tasks are not unregistered: %v", s.triggered)
+	}
+}
+
+func TestScheduler_trigger_canceled(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test uses sh syntax")
+	}
+
+	out := filepath.Join(t.TempDir(), "out")
+
+	ct, err := ParseCrontab("test", strings.NewReader(strings.Join([]string{
+		"NAME=upstream",
+		"CONCURRENCY_POLICY=replace",
+		"@daily sleep 0.3; printf u >> " + out,
+		"CONCURRENCY_POLICY=",
+		"NAME=on-success",
+		"AFTER=upstream",
+		"@after printf s >> " + out,
+		"NAME=on-failure",
+		"AFTER=",
+		"AFTER_FAILURE=upstream",
+		"@after printf f >> " + out,
+	}, "\n")), Environ{})
+	if err != nil {
+		t.Fatalf("failed to parse crontab: %s", err)
+	}
+
+	sm := NewStatusMonitor(NewTestLogger(t))
+	s := NewScheduler(context.Background(), sm, nil)
+	defer s.Shutdown(0)
+
+	ids := s.RegisterCrontab(ct, false)
+	defer s.Unregister(ids...)
+
+	// The first run is replaced by the second run, so only the second run should trigger the followers.
+	go s.RunTask(ct.Tasks[0])
+	time.Sleep(100 * time.Millisecond)
+	go s.RunTask(ct.Tasks[0])
+	time.Sleep(600 * time.Millisecond)
+
+	if bs, _ := os.ReadFile(out); string(bs) != "us" {
+		t.Errorf("unexpected output: %q", string(bs))
+	}
+}
+
+func TestScheduler_Shutdown(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test uses sleep command")
+	}
+
+	tests := []struct {
+		Name    string
+		Cron    bool
+		Grace   time.Duration
+		Output  string
+		Killed  int
+		MaxTime time.Duration
+	}{
+		{"wait", false, time.Second, "ab", 0, 900 * time.Millisecond},
+		{"kill", false, 50 * time.Millisecond, "a", 1, 500 * time.Millisecond},
+		{"wait_cron", true, time.Second, "ab", 0, 900 * time.Millisecond},
+		{"kill_cron", true, 50 * time.Millisecond, "a", 1, 250 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			t.Parallel()
+
+			out := filepath.Join(t.TempDir(), "out")
+
+			task, err := ParseTask("test", "@reboot printf a >> "+out+"; sleep 0.3; printf b >> "+out, Environ{"KILL_GRACE=100ms"})
+			if err != nil {
+				t.Fatalf("failed to parse task: %s", err)
+			}
+
+			sm := NewStatusMonitor(NewTestLogger(t))
+			s := NewScheduler(context.Background(), sm, nil)
+			go s.Run()
+
+			if tt.Cron {
+				// The task that started by cron runs in the cron job, that Shutdown should not wait for.
+				task.Schedule = cron.Every(time.Second)
+				s.RegisterTask(task)
+				for i := 0; i < 200; i++ {
+					if bs, _ := os.ReadFile(out); len(bs) > 0 {
+						break
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			} else {
+				go s.RunTask(task)
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			stime := time.Now()
+			killed := s.Shutdown(tt.Grace)
+			if d := time.Since(stime); d > tt.MaxTime {
+				t.Errorf("took too long time: %s", d)
+			}
+
+			if len(killed) != tt.Killed {
+				t.Errorf("unexpected number of killed tasks: %d", len(killed))
+			}
+
+			if bs, _ := os.ReadFile(out); string(bs) != tt.Output {
+				t.Errorf("unexpected output: expected %q but got %q", tt.Output, string(bs))
+			}
+
+			// New tasks should not start after shutdown.
+			s.RunTask(task)
+			if bs, _ := os.ReadFile(out); string(bs) != tt.Output {
+				t.Errorf("task executed after shutdown: %q", string(bs))
+			}
+		})
+	}
+}
+
+func TestScheduler_suppressed(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test uses sh syntax")
+	}
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	calendar := filepath.Join(dir, "calendar")
+	if err := os.WriteFile(calendar, []byte("*\n"), 0644); err != nil {
+		t.Fatalf("failed to write calendar: %s", err)
+	}
+
+	ct, err := ParseCrontab("test", strings.NewReader(strings.Join([]string{
+		"NAME=first",
+		"@reboot printf 1 >> " + out,
+		"NAME=second",
+		"AFTER=first",
+		"SKIP_CALENDAR=" + calendar,
+		"@after printf 2 >> " + out,
+	}, "\n")), Environ{})
+	if err != nil {
+		t.Fatalf("failed to parse crontab: %s", err)
+	}
+
+	sm := NewStatusMonitor(NewTestLogger(t))
+	s := NewScheduler(context.Background(), sm, nil)
+
+	ids := s.RegisterCrontab(ct, true)
+	time.Sleep(200 * time.Millisecond)
+	s.Unregister(ids...)
+
+	if bs, _ := os.ReadFile(out); string(bs) != "1" {
+		t.Errorf("unexpected output: %q", string(bs))
+	}
+
+	sm.Lock()
+	defer sm.Unlock()
+	if n := sm.task[ct.Tasks[1].ID].Suppressed; n != 1 {
+		t.Errorf("expected 1 suppressed run but got %d", n)
+	}
+}
+
+func TestScheduler_RunShutdownTasks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test uses sleep command")
+	}
+
+	out := filepath.Join(t.TempDir(), "out")
+
+	ct, err := ParseCrontab("test", strings.NewReader(strings.Join([]string{
+		"KILL_GRACE=10s",
+		"@shutdown printf a >> " + out,
+		"@shutdown trap '' TERM; sleep 10; printf b >> " + out,
+		"@reboot printf c >> " + out,
+		"@every 1s printf d >> " + out,
+	}, "\n")), Environ{})
+	if err != nil {
+		t.Fatalf("failed to parse crontab: %s", err)
+	}
+	if !ct.Tasks[0].IsShutdown || ct.Tasks[2].IsShutdown {
+		t.Fatalf("unexpected IsShutdown: %v %v", ct.Tasks[0].IsShutdown, ct.Tasks[2].IsShutdown)
+	}
+
+	sm := NewStatusMonitor(NewTestLogger(t))
+	s := NewScheduler(context.Background(), sm, nil)
+	go s.Run()
+
+	ids := s.RegisterCrontab(ct, false)
+	if n := len(s.cron.Entries()); n != 1 {
+		t.Errorf("@shutdown tasks should not be registered to cron: %d entries", n)
+	}
+
+	s.StopAccepting()
+
+	// The task ignores SIGTERM, so it takes the whole timeout including KILL_GRACE.
+	stime := time.Now()
+	s.RunShutdownTasks(400 * time.Millisecond)
+	if d := time.Since(stime); d < 400*time.Millisecond || d > 800*time.Millisecond {
+		t.Errorf("unexpected duration: %s", d)
+	}
+
+	// The scheduled task should not run after StopAccepting.
+	time.Sleep(1100 * time.Millisecond)
+	if bs, _ := os.ReadFile(out); string(bs) != "a" {
+		t.Errorf("unexpected output: %q", string(bs))
+	}
+
+	// Unregistered tasks should not run.
+	s.Unregister(ids...)
+	s.RunShutdownTasks(time.Second)
+	if bs, _ := os.ReadFile(out); string(bs) != "a" {
+		t.Errorf("unregistered task executed: %q", string(bs))
+	}
+
+	s.Shutdown(0)
+}
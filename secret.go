@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"strings"
+)
+
+// RedactedText is the text that replaces secrets in logs and the dashboard.
+const RedactedText = "[REDACTED]"
+
+// SetSecrets sets the values that should not be shown in logs and the dashboard.
+func (t *Task) SetSecrets(secrets []string) {
+	t.Secrets = nil
+	for _, s := range secrets {
+		if s != "" {
+			t.Secrets = append(t.Secrets, s)
+		}
+	}
+
+	// Longer secrets should be replaced first, because a secret can include another one.
+	sort.SliceStable(t.Secrets, func(i, j int) bool {
+		return len(t.Secrets[i]) > len(t.Secrets[j])
+	})
+}
+
+// Redact replaces the secrets of the task in s with RedactedText.
+func (t Task) Redact(s string) string {
+	for _, x := range t.Secrets {
+		s = strings.ReplaceAll(s, x, RedactedText)
+	}
+	return s
+}
+
+// RedactWriter is an io.Writer that replaces the secrets of the task before writing.
+//
+// It handles each write separately, so a secret that split into two writes is not redacted.
+type RedactWriter struct {
+	W    io.Writer
+	Task Task
+}
+
+// Write implements io.Writer.
+func (w RedactWriter) Write(p []byte) (int, error) {
+	if _, err := w.W.Write([]byte(w.Task.Redact(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
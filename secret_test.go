@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTask_Redact(t *testing.T) {
+	var task Task
+	task.SetSecrets([]string{"pass", "", "password123"})
+
+	tests := []struct {
+		Input  string
+		Output string
+	}{
+		{"nothing to hide", "nothing to hide"},
+		{"password is password123", RedactedText + "word is " + RedactedText},
+		{"pass=pass", RedactedText + "=" + RedactedText},
+	}
+
+	for _, tt := range tests {
+		if out := task.Redact(tt.Input); out != tt.Output {
+			t.Errorf("%q: expected %q but got %q", tt.Input, tt.Output, out)
+		}
+	}
+}
+
+func TestParseCrontab_secret(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "password")
+	if err := os.WriteFile(secret, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatalf("failed to write secret: %s", err)
+	}
+
+	ct, err := ParseCrontab("/path/to/crontab", strings.NewReader(strings.Join([]string{
+		"@daily echo before",
+		"PASSWORD=${file:" + secret + "}",
+		"LITERAL=$PASSWORD",
+		"EXPAND_ENV=yes",
+		"DSN=postgres://admin:${file:" + secret + "}@db/app",
+		"@daily echo after",
+	}, "\n")), Environ{})
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+
+	if len(ct.Tasks[0].Secrets) != 0 {
+		t.Errorf("unexpected secrets before reference: %v", ct.Tasks[0].Secrets)
+	}
+
+	task := ct.Tasks[1]
+	expected := map[string]string{
+		"PASSWORD": "s3cr3t",
+		"LITERAL":  "$PASSWORD",
+		"DSN":      "postgres://admin:s3cr3t@db/app",
+	}
+	for k, v := range expected {
+		if actual := task.Env.Get(k, ""); actual != v {
+			t.Errorf("%s: expected %q but got %q", k, v, actual)
+		}
+	}
+	if out := task.Redact(task.Env.Get("DSN", "")); out != "postgres://admin:"+RedactedText+"@db/app" {
+		t.Errorf("unexpected redacted DSN: %q", out)
+	}
+
+	_, err = ParseCrontab("/path/to/crontab", strings.NewReader("\nPASSWORD=${file:"+filepath.Join(dir, "missing")+"}"), Environ{})
+	if !errors.Is(err, os.ErrNotExist) || !strings.HasPrefix(err.Error(), "2: PASSWORD: ") {
+		t.Errorf("unexpected error for missing secret: %v", err)
+	}
+}
+
+func TestStatusMonitor_StartTask_secret(t *testing.T) {
+	sm := NewStatusMonitor(NewTestLogger(t))
+
+	var task Task
+	task.ID = 42
+	task.SetSecrets([]string{"s3cr3t"})
+
+	finish, stdout, stderr := sm.StartTask(task, 1)
+	stdout.Write([]byte("password is s3cr3t\n"))
+	stderr.Write([]byte("failed to login with s3cr3t\n"))
+	finish(1, nil, nil)
+
+	sm.RLock()
+	log := sm.task[42].Log
+	sm.RUnlock()
+	if strings.Contains(log, "s3cr3t") || !strings.Contains(log, RedactedText) {
+		t.Errorf("secret is not redacted: %q", log)
+	}
+
+	finish, _, _ = sm.StartTask(task, 1)
+	finish(1, nil, errors.New("bad password: s3cr3t"))
+
+	sm.RLock()
+	log = sm.task[42].Log
+	sm.RUnlock()
+	if log != "bad password: "+RedactedText {
+		t.Errorf("secret in error is not redacted: %q", log)
+	}
+}
@@ -40,3 +40,22 @@ func SetUID(_ LoggerHolder, cmd *exec.Cmd, u *user.User) error {
 
 	return nil
 }
+
+// SetProcessGroup makes exec.Cmd to start in a new process group.
+// It is needed to send signals to all processes that the command spawned.
+func SetProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// Terminate sends SIGTERM to the process group of the started exec.Cmd.
+func Terminate(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+// Kill sends SIGKILL to the process group of the started exec.Cmd.
+func Kill(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -27,3 +27,19 @@ func SetUID(l LoggerHolder, cmd *exec.Cmd, u *user.User) error {
 
 	return nil
 }
+
+// SetProcessGroup makes exec.Cmd to start in a new process group.
+// In Windows, this function does nothing.
+func SetProcessGroup(cmd *exec.Cmd) {
+}
+
+// Terminate stops the started exec.Cmd.
+// In Windows, there is no SIGTERM, so this function kills the process immediately.
+func Terminate(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// Kill kills the started exec.Cmd.
+func Kill(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
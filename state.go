@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StateStore is a persistent store of the last run time of each task.
+// It is used to catch up runs that missed while Concron was down.
+type StateStore struct {
+	sync.Mutex
+
+	Path string
+	last map[uint64]time.Time
+}
+
+// OpenStateStore loads a StateStore from the file.
+// If the file does not exist, it returns an empty StateStore.
+func OpenStateStore(path string) (*StateStore, error) {
+	s := &StateStore{
+		Path: path,
+		last: make(map[uint64]time.Time),
+	}
+
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var xs map[string]time.Time
+	if err := json.Unmarshal(raw, &xs); err != nil {
+		return nil, err
+	}
+	for k, v := range xs {
+		id, err := strconv.ParseUint(k, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		s.last[id] = v
+	}
+
+	return s, nil
+}
+
+// Last returns the last run time of the task.
+func (s *StateStore) Last(id uint64) (t time.Time, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	t, ok = s.last[id]
+	return
+}
+
+// Record records the last run time of the task, and saves it to the file.
+func (s *StateStore) Record(id uint64, t time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.last[id] = t
+	return s.save()
+}
+
+// Prune removes the records of the tasks that are not in the known IDs, and saves the file if changed.
+// The ID of a task changes when its line is edited, so the records of the old IDs should be removed.
+func (s *StateStore) Prune(known map[uint64]bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	changed := false
+	for id := range s.last {
+		if !known[id] {
+			delete(s.last, id)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.save()
+}
+
+func (s *StateStore) save() error {
+	xs := make(map[string]time.Time, len(s.last))
+	for k, v := range s.last {
+		xs[strconv.FormatUint(k, 10)] = v
+	}
+
+	raw, err := json.Marshal(xs)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it, to avoid to break the file when Concron stopped while writing.
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "last-runs.json")
+
+	s, err := OpenStateStore(path)
+	if err != nil {
+		t.Fatalf("failed to open: %s", err)
+	}
+
+	if _, ok := s.Last(42); ok {
+		t.Fatalf("empty store returns a value")
+	}
+
+	ts := time.Date(2021, 1, 2, 15, 4, 5, 0, time.UTC)
+	if err := s.Record(42, ts); err != nil {
+		t.Fatalf("failed to record: %s", err)
+	}
+
+	s2, err := OpenStateStore(path)
+	if err != nil {
+		t.Fatalf("failed to re-open: %s", err)
+	}
+
+	if got, ok := s2.Last(42); !ok || !got.Equal(ts) {
+		t.Errorf("unexpected last time: %s", got)
+	}
+	if _, ok := s2.Last(123); ok {
+		t.Errorf("unknown task returns a value")
+	}
+}
+
+func TestStateStore_Prune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "last-runs.json")
+
+	s, err := OpenStateStore(path)
+	if err != nil {
+		t.Fatalf("failed to open: %s", err)
+	}
+
+	ts := time.Date(2021, 1, 2, 15, 4, 5, 0, time.UTC)
+	for _, id := range []uint64{1, 2, 3} {
+		if err := s.Record(id, ts); err != nil {
+			t.Fatalf("failed to record: %s", err)
+		}
+	}
+
+	if err := s.Prune(map[uint64]bool{2: true, 4: true}); err != nil {
+		t.Fatalf("failed to prune: %s", err)
+	}
+
+	s2, err := OpenStateStore(path)
+	if err != nil {
+		t.Fatalf("failed to re-open: %s", err)
+	}
+	for id, expected := range map[uint64]bool{1: false, 2: true, 3: false, 4: false} {
+		if _, ok := s2.Last(id); ok != expected {
+			t.Errorf("%d: expected %v but got %v", id, expected, ok)
+		}
+	}
+}
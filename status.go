@@ -2,6 +2,8 @@ package main
 
 import (
 	_ "embed"
+	"errors"
+	"fmt"
 	"html/template"
 	"io"
 	"net/http"
@@ -54,6 +56,38 @@ var (
 		},
 		[]string{"source", "schedule", "user", "command", "stdin"},
 	)
+	overlapCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "task_overlapped_total",
+			Help:      "How many tasks started while the previous run was still running.",
+		},
+		[]string{"source", "schedule", "user", "command", "stdin", "action"},
+	)
+	suppressedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "task_suppressed_total",
+			Help:      "How many scheduled runs suppressed because of SKIP_CALENDAR.",
+		},
+		[]string{"source", "schedule", "user", "command", "stdin"},
+	)
+	catchUpCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "task_caught_up_total",
+			Help:      "How many missed runs executed after Concron started.",
+		},
+		[]string{"source", "schedule", "user", "command", "stdin"},
+	)
+	retryCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "task_retried_total",
+			Help:      "How many times tasks retried after failure.",
+		},
+		[]string{"source", "schedule", "user", "command", "stdin"},
+	)
 	finishedCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
@@ -72,6 +106,46 @@ var (
 		},
 		[]string{"source", "schedule", "user", "command", "stdin", "exit_code"},
 	)
+	timeoutCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "task_timeouts_total",
+			Help:      "How many tasks killed because of timeout.",
+		},
+		[]string{"source", "schedule", "user", "command", "stdin"},
+	)
+	limitCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "task_limit_exceeded_total",
+			Help:      "How many tasks killed because of resource limits.",
+		},
+		[]string{"source", "schedule", "user", "command", "stdin"},
+	)
+	memoryPeakGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "task_memory_peak_bytes",
+			Help:      "The peak memory usage of the latest run of the task. It is reported only if CONCRON_CGROUP is set.",
+		},
+		[]string{"source", "schedule", "user", "command", "stdin"},
+	)
+	cpuTimeCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "task_cpu_seconds_total",
+			Help:      "The total CPU time that the task used. It is reported only if CONCRON_CGROUP is set.",
+		},
+		[]string{"source", "schedule", "user", "command", "stdin"},
+	)
+	oomKillCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "task_oom_kills_total",
+			Help:      "How many processes of the task killed by the OOM killer. It is reported only if CONCRON_CGROUP is set.",
+		},
+		[]string{"source", "schedule", "user", "command", "stdin"},
+	)
 	exitCodeGauge = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: namespace,
@@ -80,6 +154,37 @@ var (
 		},
 		[]string{"source", "schedule", "user", "command", "stdin"},
 	)
+	groupRunningGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "concurrency_group_running_tasks",
+			Help:      "Number of running tasks in the concurrency group.",
+		},
+		[]string{"group"},
+	)
+	groupWaitingGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "concurrency_group_waiting_tasks",
+			Help:      "Number of tasks waiting for a free slot in the concurrency group.",
+		},
+		[]string{"group"},
+	)
+	groupWaitSummary = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace: namespace,
+			Name:      "concurrency_group_wait_seconds",
+			Help:      "A summary of the duration to wait for a free slot in the concurrency group.",
+		},
+		[]string{"group"},
+	)
+	atJobGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "at_jobs",
+			Help:      "Number of one-shot jobs waiting to run.",
+		},
+	)
 	loadCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
@@ -104,9 +209,22 @@ func init() {
 	prometheus.MustRegister(loadedTaskGauge)
 	prometheus.MustRegister(runningTaskGauge)
 	prometheus.MustRegister(startedCounter)
+	prometheus.MustRegister(overlapCounter)
+	prometheus.MustRegister(suppressedCounter)
+	prometheus.MustRegister(retryCounter)
+	prometheus.MustRegister(catchUpCounter)
 	prometheus.MustRegister(finishedCounter)
 	prometheus.MustRegister(durationSummary)
+	prometheus.MustRegister(timeoutCounter)
+	prometheus.MustRegister(limitCounter)
+	prometheus.MustRegister(memoryPeakGauge)
+	prometheus.MustRegister(cpuTimeCounter)
+	prometheus.MustRegister(oomKillCounter)
 	prometheus.MustRegister(exitCodeGauge)
+	prometheus.MustRegister(groupRunningGauge)
+	prometheus.MustRegister(groupWaitingGauge)
+	prometheus.MustRegister(groupWaitSummary)
+	prometheus.MustRegister(atJobGauge)
 	prometheus.MustRegister(loadCounter)
 	prometheus.MustRegister(loadDurationSummary)
 }
@@ -132,12 +250,28 @@ func (s ReadyStatus) String() string {
 	}
 }
 
+// OverlapAction is what happened to a run that started while the previous run was still running.
+type OverlapAction string
+
+const (
+	OverlapSkipped  OverlapAction = "skipped"
+	OverlapQueued   OverlapAction = "queued"
+	OverlapReplaced OverlapAction = "replaced"
+)
+
 // TaskStatus is a status of a task execution.
 type TaskStatus struct {
-	Timestamp time.Time
-	Duration  time.Duration
-	ExitCode  int
-	Log       string
+	Timestamp  time.Time
+	Duration   time.Duration
+	ExitCode   int
+	TimedOut   bool
+	Reason     string
+	Usage      *ResourceUsage
+	Attempt    int
+	Log        string
+	Skipped    int
+	Replaced   int
+	Suppressed int
 }
 
 // CrontabStatus is a status of a crontab.
@@ -153,7 +287,9 @@ type StatusMonitor struct {
 	logger  *zap.Logger
 	crontab map[string]*CrontabStatus
 	task    map[uint64]TaskStatus
+	group   map[string]GroupStatus
 	ready   ReadyStatus
+	at      *AtQueue
 }
 
 func NewStatusMonitor(l *zap.Logger) *StatusMonitor {
@@ -161,6 +297,7 @@ func NewStatusMonitor(l *zap.Logger) *StatusMonitor {
 		logger:  l,
 		crontab: make(map[string]*CrontabStatus),
 		task:    make(map[uint64]TaskStatus),
+		group:   make(map[string]GroupStatus),
 	}
 }
 
@@ -257,9 +394,29 @@ func (sm *StatusMonitor) StartTerminating() {
 	sm.Unlock()
 }
 
+// SetAtQueue sets the AtQueue to serve the HTTP API and to show jobs on the dashboard.
+func (sm *StatusMonitor) SetAtQueue(q *AtQueue) {
+	sm.Lock()
+	sm.at = q
+	sm.Unlock()
+}
+
+// AtJobs returns the one-shot jobs waiting to run.
+func (sm *StatusMonitor) AtJobs() []AtJob {
+	sm.RLock()
+	q := sm.at
+	sm.RUnlock()
+
+	if q == nil {
+		return nil
+	}
+	return q.Jobs()
+}
+
 // StartTask reports a task has started.
+// The attempt is 1 for the first execution, and increases on each retry.
 // This function returns a function to report the task has finished, and io.Writer for logging.
-func (sm *StatusMonitor) StartTask(t Task) (finish func(exitCode int, err error), stdout, stderr io.Writer) {
+func (sm *StatusMonitor) StartTask(t Task, attempt int) (finish func(exitCode int, usage *ResourceUsage, err error), stdout, stderr io.Writer) {
 	sm.Lock()
 	if s, ok := sm.crontab[t.Source]; ok {
 		s.Running++
@@ -268,6 +425,9 @@ func (sm *StatusMonitor) StartTask(t Task) (finish func(exitCode int, err error)
 	sm.Unlock()
 
 	startedCounter.WithLabelValues(t.Source, t.ScheduleSpec, t.User, t.Command, t.Stdin).Inc()
+	if attempt > 1 {
+		retryCounter.WithLabelValues(t.Source, t.ScheduleSpec, t.User, t.Command, t.Stdin).Inc()
+	}
 
 	l := sm.logger.With(
 		zap.String("source", t.Source),
@@ -276,21 +436,51 @@ func (sm *StatusMonitor) StartTask(t Task) (finish func(exitCode int, err error)
 		zap.String("command", t.Command),
 		zap.String("stdin", t.Stdin),
 	)
+	if t.MaxAttempts() > 1 {
+		l = l.With(zap.Int("attempt", attempt), zap.Int("max_attempts", t.MaxAttempts()))
+	}
 	l.Info("start")
 
 	var logRecord strings.Builder
 	stdout = io.MultiWriter(&logRecord, NewStdoutLogger(sm.logger, t))
 	stderr = io.MultiWriter(&logRecord, NewStderrLogger(sm.logger, t))
+	if len(t.Secrets) > 0 {
+		stdout = RedactWriter{stdout, t}
+		stderr = RedactWriter{stderr, t}
+	}
 
 	stime := time.Now()
 
-	finish = func(exitCode int, err error) {
+	finish = func(exitCode int, usage *ResourceUsage, err error) {
 		duration := time.Since(stime)
 
 		finishedCounter.WithLabelValues(t.Source, t.ScheduleSpec, t.User, t.Command, t.Stdin, strconv.Itoa(exitCode)).Inc()
 		durationSummary.WithLabelValues(t.Source, t.ScheduleSpec, t.User, t.Command, t.Stdin, strconv.Itoa(exitCode)).Observe(duration.Seconds())
 		exitCodeGauge.WithLabelValues(t.Source, t.ScheduleSpec, t.User, t.Command, t.Stdin).Set(float64(exitCode))
 
+		timedOut := errors.Is(err, ErrTimeout)
+		if timedOut {
+			timeoutCounter.WithLabelValues(t.Source, t.ScheduleSpec, t.User, t.Command, t.Stdin).Inc()
+		}
+
+		var reason string
+		if errors.Is(err, ErrLimitExceeded) {
+			limitCounter.WithLabelValues(t.Source, t.ScheduleSpec, t.User, t.Command, t.Stdin).Inc()
+			reason = err.Error()
+		}
+
+		if err != nil && len(t.Secrets) > 0 {
+			err = errors.New(t.Redact(err.Error()))
+			reason = t.Redact(reason)
+		}
+
+		if usage != nil {
+			memoryPeakGauge.WithLabelValues(t.Source, t.ScheduleSpec, t.User, t.Command, t.Stdin).Set(float64(usage.MemoryPeak))
+			cpuTimeCounter.WithLabelValues(t.Source, t.ScheduleSpec, t.User, t.Command, t.Stdin).Add(usage.CPUTime.Seconds())
+			oomKillCounter.WithLabelValues(t.Source, t.ScheduleSpec, t.User, t.Command, t.Stdin).Add(float64(usage.OOMKills))
+			l = l.With(zap.Uint64("memory_peak", usage.MemoryPeak), zap.Duration("cpu_time", usage.CPUTime), zap.Int("oom_kills", usage.OOMKills))
+		}
+
 		l = l.With(zap.Int("exit_code", exitCode), zap.Duration("duration", duration), zap.Error(err))
 		if err == nil {
 			l.Info("finish")
@@ -308,18 +498,148 @@ func (sm *StatusMonitor) StartTask(t Task) (finish func(exitCode int, err error)
 			s.Running--
 			runningTaskGauge.WithLabelValues(t.Source, t.User).Dec()
 		}
-		sm.task[t.ID] = TaskStatus{
-			Timestamp: stime,
-			Duration:  duration,
-			ExitCode:  exitCode,
-			Log:       log,
-		}
+		s := sm.task[t.ID]
+		s.Timestamp = stime
+		s.Duration = duration
+		s.ExitCode = exitCode
+		s.TimedOut = timedOut
+		s.Reason = reason
+		s.Usage = usage
+		s.Attempt = attempt
+		s.Log = log
+		sm.task[t.ID] = s
 		sm.Unlock()
 	}
 
 	return
 }
 
+// CaughtUp reports a task will run because it missed the run at the scheduled time.
+func (sm *StatusMonitor) CaughtUp(t Task, missed time.Time) {
+	catchUpCounter.WithLabelValues(t.Source, t.ScheduleSpec, t.User, t.Command, t.Stdin).Inc()
+
+	sm.logger.Info(
+		"catch up",
+		zap.String("source", t.Source),
+		zap.String("schedule", t.ScheduleSpec),
+		zap.String("user", t.User),
+		zap.String("command", t.Command),
+		zap.String("stdin", t.Stdin),
+		zap.Time("missed", missed),
+	)
+}
+
+// GroupWaited reports a task has waited for a free slot in the concurrency group.
+func (sm *StatusMonitor) GroupWaited(t Task, group string, d time.Duration) {
+	groupWaitSummary.WithLabelValues(group).Observe(d.Seconds())
+
+	sm.logger.Debug(
+		"wait for concurrency group",
+		zap.String("source", t.Source),
+		zap.String("schedule", t.ScheduleSpec),
+		zap.String("user", t.User),
+		zap.String("command", t.Command),
+		zap.String("stdin", t.Stdin),
+		zap.String("group", group),
+		zap.Duration("duration", d),
+	)
+}
+
+// GroupChanged reports the status of a concurrency group has changed.
+func (sm *StatusMonitor) GroupChanged(s GroupStatus) {
+	groupRunningGauge.WithLabelValues(s.Name).Set(float64(s.Running))
+	groupWaitingGauge.WithLabelValues(s.Name).Set(float64(s.Waiting))
+
+	sm.Lock()
+	sm.group[s.Name] = s
+	sm.Unlock()
+}
+
+// Groups returns the status of concurrency groups that have a limit.
+func (sm *StatusMonitor) Groups() []GroupStatus {
+	sm.RLock()
+	defer sm.RUnlock()
+
+	var r []GroupStatus
+	for _, g := range sm.group {
+		if g.Limit > 0 {
+			r = append(r, g)
+		}
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Name < r[j].Name
+	})
+
+	return r
+}
+
+// Triggered reports a task will run because the upstream task has finished.
+func (sm *StatusMonitor) Triggered(t Task, upstream Task, upstreamErr error) {
+	sm.logger.Info(
+		"trigger",
+		zap.String("source", t.Source),
+		zap.String("schedule", t.ScheduleSpec),
+		zap.String("user", t.User),
+		zap.String("command", t.Command),
+		zap.String("stdin", t.Stdin),
+		zap.String("upstream", upstream.Name),
+		zap.Bool("upstream_succeeded", upstreamErr == nil),
+	)
+}
+
+// Overlapped reports a task has been started while the previous run is still running.
+func (sm *StatusMonitor) Overlapped(t Task, action OverlapAction) {
+	overlapCounter.WithLabelValues(t.Source, t.ScheduleSpec, t.User, t.Command, t.Stdin, string(action)).Inc()
+
+	l := sm.logger.With(
+		zap.String("source", t.Source),
+		zap.String("schedule", t.ScheduleSpec),
+		zap.String("user", t.User),
+		zap.String("command", t.Command),
+		zap.String("stdin", t.Stdin),
+		zap.String("policy", t.Policy.String()),
+	)
+	if action == OverlapQueued {
+		l.Info(string(action))
+	} else {
+		l.Warn(string(action))
+	}
+
+	sm.Lock()
+	s := sm.task[t.ID]
+	switch action {
+	case OverlapSkipped:
+		s.Skipped++
+	case OverlapReplaced:
+		s.Replaced++
+	}
+	sm.task[t.ID] = s
+	sm.Unlock()
+}
+
+// Suppressed reports a scheduled run is not executed because it is in a blackout of SKIP_CALENDAR.
+func (sm *StatusMonitor) Suppressed(t Task, until time.Time) {
+	suppressedCounter.WithLabelValues(t.Source, t.ScheduleSpec, t.User, t.Command, t.Stdin).Inc()
+
+	sm.logger.Info(
+		"suppressed",
+		zap.String("source", t.Source),
+		zap.String("schedule", t.ScheduleSpec),
+		zap.String("user", t.User),
+		zap.String("command", t.Command),
+		zap.String("stdin", t.Stdin),
+		zap.String("calendar", t.Calendar.Path),
+		zap.Time("until", until),
+	)
+
+	sm.Lock()
+	s := sm.task[t.ID]
+	s.Suppressed++
+	sm.task[t.ID] = s
+	sm.Unlock()
+}
+
 type TaskWithStatus struct {
 	Task
 	TaskStatus
@@ -330,7 +650,10 @@ type TaskWithStatus struct {
 func (ts TaskWithStatus) TimestampStr() string {
 	t := ts.Timestamp
 	if t.IsZero() {
-		t = ts.Schedule.Next(time.Now())
+		t = ts.Next(time.Now())
+	}
+	if t.IsZero() {
+		return "never"
 	}
 	return humanize.Time(t)
 }
@@ -359,9 +682,45 @@ func (ts TaskWithStatus) ExitCodeStr() string {
 	}
 }
 
+// AttemptStr returns which attempt the last execution was, like "succeeded on attempt 3 of 5".
+// If the task has no retry setting or not executed yet, it returns empty string.
+func (ts TaskWithStatus) AttemptStr() string {
+	if ts.MaxAttempts() <= 1 || ts.Timestamp.IsZero() {
+		return ""
+	}
+
+	result := "succeeded"
+	if ts.ExitCode != 0 || ts.TimedOut {
+		result = "failed"
+	}
+	s := fmt.Sprintf("%s on attempt %d of %d", result, ts.Attempt, ts.MaxAttempts())
+	if result == "failed" && ts.Attempt < ts.MaxAttempts() {
+		s += ", retrying"
+	}
+	return s
+}
+
+// UsageStr returns the resource usage of the last execution, like "memory peak 12 MiB, CPU time 1.5s".
+// If the usage is not measured, it returns empty string.
+func (ts TaskWithStatus) UsageStr() string {
+	if ts.Usage == nil {
+		return ""
+	}
+
+	s := "CPU time " + ts.Usage.CPUTime.String()
+	if ts.Usage.MemoryPeak > 0 {
+		s = "memory peak " + humanize.IBytes(ts.Usage.MemoryPeak) + ", " + s
+	}
+	if ts.Usage.OOMKills > 0 {
+		s += fmt.Sprintf(", %d processes killed by OOM killer", ts.Usage.OOMKills)
+	}
+	return s
+}
+
 type StatusSnapshot struct {
-	Path  string
-	Tasks []TaskWithStatus
+	Path         string
+	Tasks        []TaskWithStatus
+	Dependencies []Dependency
 }
 
 // Status reports the current status and logs.
@@ -372,7 +731,10 @@ func (sm *StatusMonitor) Status() []StatusSnapshot {
 	var r []StatusSnapshot
 
 	for path, ct := range sm.crontab {
-		ss := StatusSnapshot{Path: path}
+		ss := StatusSnapshot{
+			Path:         path,
+			Dependencies: Crontab{Tasks: ct.Tasks}.Dependencies(),
+		}
 		for _, t := range ct.Tasks {
 			s, _ := sm.task[t.ID]
 			ss.Tasks = append(ss.Tasks, TaskWithStatus{
@@ -408,6 +770,17 @@ var iconSvg []byte
 func (sm *StatusMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var err error
 
+	if r.URL.Path == "/api/jobs" || strings.HasPrefix(r.URL.Path, "/api/jobs/") {
+		sm.RLock()
+		q := sm.at
+		sm.RUnlock()
+
+		if q != nil {
+			q.ServeHTTP(w, r)
+			return
+		}
+	}
+
 	if r.Method != "GET" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		err = errorPageTemplate.Execute(w, "Method not allowed")
@@ -422,6 +795,8 @@ func (sm *StatusMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "text/html; charset=utf-8")
 			err = statusPageTemplate.Execute(w, map[string]interface{}{
 				"Status": sm.Status(),
+				"Groups": sm.Groups(),
+				"Jobs":   sm.AtJobs(),
 			})
 		case "/livez", "/healthz":
 			_, err = w.Write([]byte("ok\n"))
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -29,6 +34,29 @@ func TestTaskWithStatus_DurationStr(t *testing.T) {
 	}
 }
 
+func TestTaskWithStatus_AttemptStr(t *testing.T) {
+	tests := []struct {
+		RetryCount int
+		Status     TaskStatus
+		Str        string
+	}{
+		{0, TaskStatus{Timestamp: time.Now(), Attempt: 1}, ""},
+		{4, TaskStatus{}, ""},
+		{4, TaskStatus{Timestamp: time.Now(), Attempt: 3}, "succeeded on attempt 3 of 5"},
+		{4, TaskStatus{Timestamp: time.Now(), Attempt: 2, ExitCode: 1}, "failed on attempt 2 of 5, retrying"},
+		{4, TaskStatus{Timestamp: time.Now(), Attempt: 5, ExitCode: 1}, "failed on attempt 5 of 5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Str, func(t *testing.T) {
+			ts := TaskWithStatus{Task: Task{RetryCount: tt.RetryCount}, TaskStatus: tt.Status}
+			if s := ts.AttemptStr(); s != tt.Str {
+				t.Errorf("expected %q but got %q", tt.Str, s)
+			}
+		})
+	}
+}
+
 func TestStatusMonitor_Status(t *testing.T) {
 	sm := NewStatusMonitor(NewTestLogger(t))
 
@@ -55,8 +83,8 @@ func TestStatusMonitor_Status(t *testing.T) {
 
 	// ---------- run ----------
 
-	finish, _, _ := sm.StartTask(Task{ID: 42, Source: source})
-	finish(1, nil)
+	finish, _, _ := sm.StartTask(Task{ID: 42, Source: source}, 1)
+	finish(1, nil, nil)
 
 	if status := sm.Status(); len(status) != 1 {
 		t.Errorf("unexpected number of status: %v", status)
@@ -98,3 +126,49 @@ func TestStatusMonitor_Status(t *testing.T) {
 		t.Errorf("unexpected number of status: %v", status)
 	}
 }
+
+func TestStatusMonitor_ServeHTTP(t *testing.T) {
+	sm := NewStatusMonitor(NewTestLogger(t))
+
+	calendar := filepath.Join(t.TempDir(), "calendar")
+	if err := os.WriteFile(calendar, []byte("Sat,Sun\n"), 0644); err != nil {
+		t.Fatalf("failed to write calendar: %s", err)
+	}
+
+	ct, err := ParseCrontab("/path/to/crontab", strings.NewReader(strings.Join([]string{
+		"@reboot echo hello",
+		"NAME=first",
+		"H H * * * echo world",
+		"NAME=second",
+		"AFTER=first",
+		"@after echo after",
+		"NAME=",
+		"AFTER=",
+		"SKIP_CALENDAR=" + calendar,
+		"@daily echo weekday",
+	}, "\n")), Environ{})
+	if err != nil {
+		t.Fatalf("failed to parse crontab: %s", err)
+	}
+	sm.StartLoad(ct.Path)(ct, nil)
+
+	finish, _, _ := sm.StartTask(ct.Tasks[0], 1)
+	finish(0, nil, nil)
+
+	sm.Suppressed(ct.Tasks[3], time.Now())
+	sm.Suppressed(ct.Tasks[3], time.Now())
+
+	w := httptest.NewRecorder()
+	sm.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+
+	body := w.Body.String()
+	for _, want := range []string{"/path/to/crontab", "first -- succeeded --&gt; second", "after first succeeded", "H H * * *", "skips blackouts in " + calendar + ", suppressed 2 runs"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("dashboard does not include %q", want)
+		}
+	}
+}
@@ -3,19 +3,47 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"hash/crc64"
 	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/google/shlex"
 	"github.com/robfig/cron/v3"
 	"go.uber.org/zap"
 )
 
 var (
-	hashTable      = crc64.MakeTable(crc64.ISO)
-	ErrInvalidLine = errors.New("invalid line")
+	hashTable             = crc64.MakeTable(crc64.ISO)
+	ErrInvalidLine        = errors.New("invalid line")
+	ErrInvalidHeredoc     = errors.New("heredoc can not be used with stdin by %")
+	ErrTimeout            = errors.New("timed out")
+	ErrInvalidAfter       = errors.New("@after must be used with AFTER or AFTER_FAILURE, and they must be used with @after")
+	ErrInvalidGroup       = errors.New("CONCURRENCY_GROUP can not be \"" + GlobalGroupName + "\"")
+	ErrInvalidGroupLimit  = errors.New("CONCURRENCY_LIMIT must be a positive integer")
+	ErrInvalidRandomDelay = errors.New("RANDOM_DELAY must not be negative")
+	ErrInvalidWorkDir     = errors.New("WORKDIR must be an absolute path to a directory")
+	ErrInvalidRetry       = errors.New("RETRY_COUNT and RETRY_DELAY must not be negative, and RETRY_BACKOFF must be 1 or greater")
+)
+
+const (
+	// DefaultKillGrace is the default duration to wait between SIGTERM and SIGKILL.
+	DefaultKillGrace = 10 * time.Second
+
+	// DefaultRetryDelay is the default delay before the first retry.
+	DefaultRetryDelay = 10 * time.Second
+
+	// DefaultRetryBackoff is the default multiplier of the delay for each retry.
+	DefaultRetryBackoff = 2.0
+
+	// MaxRetryDelay is the upper bound of the delay that grows by RETRY_BACKOFF.
+	MaxRetryDelay = 24 * time.Hour
 )
 
 // Task is a single task in the crontab.
@@ -24,34 +52,88 @@ type Task struct {
 	ID           uint64
 	Source       string
 	ScheduleSpec string
+	ResolvedSpec string
 	Schedule     cron.Schedule
 	User         string
 	Command      string
 	Stdin        string
+	Heredoc      string
 	Env          Environ
 	IsReboot     bool
+	IsShutdown   bool
+	Policy       ConcurrencyPolicy
+	DSTPolicy    DSTPolicy
+	Timeout      time.Duration
+	KillGrace    time.Duration
+	RetryCount   int
+	RetryDelay   time.Duration
+	RetryBackoff float64
+	RandomDelay  time.Duration
+	CatchUp      bool
+	CatchUpAge   time.Duration
+	Group        string
+	GroupLimit   int
+	Name         string
+	After        string
+	AfterFailure string
+	Limits       []ResourceLimit
+	Cgroup       CgroupLimits
+	Priority     Priority
+	WorkDir      string
+	Calendar     *Calendar
+	Secrets      []string
+
+	// cgroupRoot is CONCRON_CGROUP of Concron, that set by Scheduler when the task runs.
+	// It is not read from the task env, because tasks should not be able to choose where Concron writes.
+	cgroupRoot string
 }
 
 // ParseTask parses one line in the crontab and returns Task.
 // This function returns error if the schedule spec is wrong, but it don't returns error even if the command is wrong.
 func ParseTask(source string, s string, env Environ) (Task, error) {
-	t := Task{Source: source, Env: env}
+	return parseTask(source, s, env, "", "")
+}
 
-	var err error
-	t.ScheduleSpec, t.User, t.Command, t.Stdin, err = SplitTaskLine(s, env.GetBool("ENABLE_USER_COLUMN"))
+// parseTask is ParseTask that can take the stdin from a heredoc.
+// If heredoc is not empty, it is the delimiter of the heredoc and stdin is its body, and the line can not have the stdin part.
+func parseTask(source string, s string, env Environ, heredoc, stdin string) (Task, error) {
+	spec, user, command, lineStdin, err := SplitTaskLine(s, env.GetBool("ENABLE_USER_COLUMN"), env.GetBool("SCHEDULE_SECONDS"))
 	if err != nil {
 		return Task{}, err
 	}
 
-	if t.ScheduleSpec == "@reboot" {
-		t.IsReboot = true
-	} else {
-		var err error
-		tz := env.Get("CRON_TZ", env.Get("TZ", ""))
-		t.Schedule, err = cron.ParseStandard("CRON_TZ=" + tz + " " + t.ScheduleSpec)
-		if err != nil {
-			return Task{}, err
+	if heredoc != "" {
+		if lineStdin != "" {
+			return Task{}, ErrInvalidHeredoc
 		}
+		lineStdin = stdin
+	}
+
+	t, err := NewTask(source, spec, user, command, lineStdin, env)
+	if err != nil {
+		return Task{}, err
+	}
+	t.Heredoc = heredoc
+	return t, nil
+}
+
+// NewTask makes a Task from the parts of a task, that are the same as the columns in the crontab.
+// The user "*" means the same user as Concron.
+func NewTask(source, spec, user, command, stdin string, env Environ) (Task, error) {
+	t := Task{
+		Source:       source,
+		ScheduleSpec: spec,
+		User:         user,
+		Command:      command,
+		Stdin:        stdin,
+		Env:          env,
+	}
+
+	var err error
+	withSeconds := env.GetBool("SCHEDULE_SECONDS")
+
+	if err = t.parseOptions(env); err != nil {
+		return Task{}, err
 	}
 
 	id := crc64.New(hashTable)
@@ -68,12 +150,261 @@ func ParseTask(source string, s string, env Environ) (Task, error) {
 	}
 	t.ID = id.Sum64()
 
+	// The ID is required to resolve H in the spec.
+	t.ResolvedSpec, err = ResolveHashSpec(t.ScheduleSpec, t.ID)
+	if err != nil {
+		return Task{}, err
+	}
+
+	switch {
+	case t.ScheduleSpec == "@reboot":
+		t.IsReboot = true
+	case t.ScheduleSpec == "@shutdown":
+		t.IsShutdown = true
+	case t.ScheduleSpec == "@after" || t.IsTriggered():
+		if t.ScheduleSpec != "@after" || !t.IsTriggered() {
+			return Task{}, ErrInvalidAfter
+		}
+		t.Schedule = AfterSchedule{}
+	default:
+		var err error
+		tz := env.Get("CRON_TZ", env.Get("TZ", ""))
+		t.Schedule, err = ParseSchedule(t.ResolvedSpec, tz, withSeconds)
+		if err != nil {
+			return Task{}, err
+		}
+		if t.DSTPolicy == DSTVixie && isFixedTimeSpec(t.ResolvedSpec) {
+			t.Schedule, err = NewVixieSchedule(t.ResolvedSpec, tz, withSeconds)
+			if err != nil {
+				return Task{}, err
+			}
+		}
+	}
+
+	if t.RandomDelay > 0 && t.Schedule != nil {
+		t.Schedule = NewDelayedSchedule(t, t.RandomDelay, !env.GetBool("RANDOM_DELAY_STABLE"))
+	}
+
 	return t, nil
 }
 
+// parseOptions reads options for execution from the Environ.
+func (t *Task) parseOptions(env Environ) (err error) {
+	t.Policy, err = ParseConcurrencyPolicy(env.Get("CONCURRENCY_POLICY", ""))
+	if err != nil {
+		return err
+	}
+
+	t.DSTPolicy, err = ParseDSTPolicy(env.Get("DST_POLICY", ""))
+	if err != nil {
+		return err
+	}
+
+	t.Timeout, err = env.GetDuration("TIMEOUT", 0)
+	if err != nil {
+		return err
+	}
+
+	t.KillGrace, err = env.GetDuration("KILL_GRACE", DefaultKillGrace)
+	if err != nil {
+		return err
+	}
+
+	t.RetryCount, err = env.GetInt("RETRY_COUNT", 0)
+	if err != nil {
+		return err
+	}
+
+	t.RetryDelay, err = env.GetDuration("RETRY_DELAY", DefaultRetryDelay)
+	if err != nil {
+		return err
+	}
+
+	t.RetryBackoff, err = env.GetFloat("RETRY_BACKOFF", DefaultRetryBackoff)
+	if err != nil {
+		return err
+	}
+	if t.RetryCount < 0 || t.RetryDelay < 0 || t.RetryBackoff < 1 {
+		return ErrInvalidRetry
+	}
+
+	// A number without unit is minutes, for compatibility with cronie.
+	if m, err := strconv.Atoi(env.Get("RANDOM_DELAY", "")); err == nil {
+		t.RandomDelay = time.Duration(m) * time.Minute
+	} else if t.RandomDelay, err = env.GetDuration("RANDOM_DELAY", 0); err != nil {
+		return err
+	}
+	if t.RandomDelay < 0 {
+		return ErrInvalidRandomDelay
+	}
+
+	t.Name = env.Get("NAME", "")
+	t.After = env.Get("AFTER", "")
+	t.AfterFailure = env.Get("AFTER_FAILURE", "")
+
+	t.Group = env.Get("CONCURRENCY_GROUP", "")
+	if t.Group == GlobalGroupName {
+		return ErrInvalidGroup
+	}
+
+	// GroupLimit is 0 if not specified, to not change the limit that declared by other tasks.
+	t.GroupLimit, err = env.GetInt("CONCURRENCY_LIMIT", 0)
+	if err != nil {
+		return err
+	}
+	if t.GroupLimit < 0 || (t.GroupLimit == 0 && env.Get("CONCURRENCY_LIMIT", "") != "") {
+		return ErrInvalidGroupLimit
+	}
+
+	// CATCH_UP accepts both of boolean and maximum age.
+	if d, err := time.ParseDuration(env.Get("CATCH_UP", "")); err == nil {
+		t.CatchUp = d > 0
+		t.CatchUpAge = d
+	} else {
+		t.CatchUp = env.GetBool("CATCH_UP")
+	}
+
+	t.Limits, err = ParseResourceLimits(env)
+	if err != nil {
+		return err
+	}
+
+	t.Cgroup, err = ParseCgroupLimits(env)
+	if err != nil {
+		return err
+	}
+
+	t.Priority, err = ParsePriority(env)
+	if err != nil {
+		return err
+	}
+
+	if path := env.Get("SKIP_CALENDAR", ""); path != "" {
+		loc, err := time.LoadLocation(env.Get("CRON_TZ", env.Get("TZ", "")))
+		if err != nil {
+			return err
+		}
+		t.Calendar, err = LoadCalendar(path, loc)
+		if err != nil {
+			return fmt.Errorf("SKIP_CALENDAR: %w", err)
+		}
+	}
+
+	t.WorkDir = env.Get("WORKDIR", "")
+	if t.WorkDir != "" {
+		if !filepath.IsAbs(t.WorkDir) {
+			return ErrInvalidWorkDir
+		}
+		if stat, err := os.Stat(t.WorkDir); err != nil {
+			return fmt.Errorf("WORKDIR: %w", err)
+		} else if !stat.IsDir() {
+			return fmt.Errorf("%w: %s", ErrInvalidWorkDir, t.WorkDir)
+		}
+	}
+
+	return nil
+}
+
+// Missed returns the latest scheduled time between last and now.
+// If there is no such time, or it is older than CatchUpAge, the second result is false.
+func (t Task) Missed(last, now time.Time) (time.Time, bool) {
+	if t.Schedule == nil {
+		return time.Time{}, false
+	}
+
+	from := last
+	if t.CatchUpAge > 0 && now.Add(-t.CatchUpAge).After(from) {
+		from = now.Add(-t.CatchUpAge)
+	}
+
+	var missed time.Time
+	for next := t.Schedule.Next(from); !next.IsZero() && next.Before(now); next = t.Schedule.Next(next) {
+		missed = next
+	}
+	return missed, !missed.IsZero()
+}
+
+// Next returns the next time to run the task after now, skipping the blackouts of SKIP_CALENDAR.
+// It returns zero time if the task does not run on schedule.
+func (t Task) Next(now time.Time) time.Time {
+	if t.Schedule == nil {
+		return time.Time{}
+	}
+
+	next := t.Schedule.Next(now)
+	for i := 0; i < maxBlackoutSkips && !next.IsZero(); i++ {
+		until, ok := t.Calendar.Blackout(next)
+		if !ok {
+			return next
+		}
+		next = t.Schedule.Next(until.Add(-time.Nanosecond))
+	}
+	return time.Time{}
+}
+
+// IsTriggered checks if the task runs after another task instead of on schedule.
+func (t Task) IsTriggered() bool {
+	return t.After != "" || t.AfterFailure != ""
+}
+
+// MaxAttempts returns how many times the task can be executed in a single run.
+func (t Task) MaxAttempts() int {
+	return t.RetryCount + 1
+}
+
 // Run runs the task.
-func (t Task) Run(ctx context.Context, sm TaskReporter) {
-	finish, stdout, stderr := sm.StartTask(t)
+// If the task failed, it retries up to RetryCount times, with the delay that grows by RetryBackoff.
+// The result is the error of the last attempt.
+func (t Task) Run(ctx context.Context, sm TaskReporter) error {
+	delay := t.RetryDelay
+
+	for attempt := 1; ; attempt++ {
+		err := t.runAttempt(ctx, sm, attempt)
+		if err == nil || attempt >= t.MaxAttempts() || ctx.Err() != nil {
+			return err
+		}
+
+		sm.L().Info(
+			"retry",
+			zap.String("source", t.Source),
+			zap.String("schedule", t.ScheduleSpec),
+			zap.String("user", t.User),
+			zap.String("command", t.Command),
+			zap.String("stdin", t.Stdin),
+			zap.Int("attempt", attempt+1),
+			zap.Int("max_attempts", t.MaxAttempts()),
+			zap.Duration("delay", delay),
+		)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+
+		delay = t.nextRetryDelay(delay)
+	}
+}
+
+// nextRetryDelay returns the delay multiplied by RetryBackoff.
+// It is up to MaxRetryDelay, or RetryDelay if it is longer than that, to not overflow the time.Duration.
+func (t Task) nextRetryDelay(delay time.Duration) time.Duration {
+	limit := MaxRetryDelay
+	if t.RetryDelay > limit {
+		limit = t.RetryDelay
+	}
+
+	if d := float64(delay) * t.RetryBackoff; d < float64(limit) {
+		return time.Duration(d)
+	}
+	return limit
+}
+
+// runAttempt executes the command once.
+func (t Task) runAttempt(ctx context.Context, sm TaskReporter, attempt int) error {
+	finish, stdout, stderr := sm.StartTask(t, attempt)
 
 	args := []string{t.Command}
 	if t.Env.GetBool("PARSE_COMMAND") {
@@ -82,23 +413,118 @@ func (t Task) Run(ctx context.Context, sm TaskReporter) {
 		}
 	}
 
-	cmd := exec.CommandContext(
-		ctx,
+	cmd := exec.Command(
 		t.Env.Get("SHELL", DefaultShell),
 		append(ShellOpts(t.Env), args...)...,
 	)
 	cmd.Stdin = strings.NewReader(t.Stdin)
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
-	cmd.Env = []string(t.Env)
+	env := append(Environ{}, t.Env...)
+	env.Set("CONCRON_ATTEMPT=" + strconv.Itoa(attempt))
+	cmd.Env = []string(env)
 
 	if err := SetUserInfo(sm, cmd, t.User); err != nil {
-		finish(-1, err)
-		return
+		finish(-1, nil, err)
+		return err
+	}
+	if t.WorkDir != "" {
+		cmd.Dir = t.WorkDir
+		env := Environ(cmd.Env)
+		env.Set("PWD=" + t.WorkDir)
+		cmd.Env = []string(env)
+	}
+	SetProcessGroup(cmd)
+	if err := SetResourceLimits(sm, cmd, t.Limits); err != nil {
+		finish(-1, nil, err)
+		return err
+	}
+	if err := SetPriority(sm, cmd, t.Priority); err != nil {
+		finish(-1, nil, err)
+		return err
 	}
 
-	err := cmd.Run()
-	finish(cmd.ProcessState.ExitCode(), err)
+	cg, err := StartCgroup(sm, cmd, t)
+	if err != nil {
+		finish(-1, nil, err)
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		cg.Close()
+		finish(-1, nil, err)
+		return err
+	}
+
+	if err := cg.Place(cmd.Process.Pid); err != nil {
+		Kill(cmd)
+		cmd.Wait()
+		cg.Close()
+		finish(-1, nil, err)
+		return err
+	}
+
+	err = t.wait(ctx, sm, cmd)
+
+	// Close the cgroup even if the task succeeded, to clean up remaining processes.
+	usage, cerr := cg.Close()
+	if cerr != nil {
+		sm.L().Warn("failed to remove cgroup", zap.Error(cerr))
+	}
+
+	if _, ok := err.(*exec.ExitError); ok {
+		if lerr := CheckLimitViolation(cmd.ProcessState, t.Limits); lerr != nil {
+			err = lerr
+		} else if usage != nil && usage.OOMKills > 0 {
+			err = fmt.Errorf("%w: memory (MEMORY_MAX=%s), killed by OOM killer", ErrLimitExceeded, humanize.IBytes(t.Cgroup.MemoryMax))
+		}
+	}
+	finish(cmd.ProcessState.ExitCode(), usage, err)
+	return err
+}
+
+// wait waits for the command to exit.
+// If the context is canceled or the Timeout exceeded, it sends SIGTERM to the command, and then sends SIGKILL after the KillGrace.
+func (t Task) wait(ctx context.Context, l LoggerHolder, cmd *exec.Cmd) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var timeout <-chan time.Time
+	if t.Timeout > 0 {
+		timer := time.NewTimer(t.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var reason error
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		reason = ctx.Err()
+	case <-timeout:
+		reason = fmt.Errorf("%w after %s", ErrTimeout, t.Timeout)
+	}
+
+	if err := Terminate(cmd); err != nil {
+		l.L().Debug("failed to send SIGTERM", zap.Int("pid", cmd.Process.Pid), zap.Error(err))
+	}
+
+	grace := time.NewTimer(t.KillGrace)
+	defer grace.Stop()
+
+	select {
+	case <-done:
+	case <-grace.C:
+		if err := Kill(cmd); err != nil {
+			l.L().Debug("failed to send SIGKILL", zap.Int("pid", cmd.Process.Pid), zap.Error(err))
+		}
+		<-done
+	}
+
+	return reason
 }
 
 // EscapedStdin is Stdin but escaped % and \n.
@@ -107,15 +533,28 @@ func (t Task) EscapedStdin() string {
 }
 
 // CommandWithStdin returns the command part in the crontab spec.
+// If the stdin is given by a heredoc, the result has multiple lines.
 func (t Task) CommandWithStdin() string {
 	cmd := strings.ReplaceAll(t.Command, "%", "\\%")
-	if t.Stdin == "" {
+	switch {
+	case t.Heredoc != "":
+		return cmd + " " + t.heredocStr()
+	case t.Stdin == "":
 		return cmd
-	} else {
+	default:
 		return cmd + " %" + t.EscapedStdin()
 	}
 }
 
+// heredocStr returns the heredoc part in the crontab spec, like "<<EOF\nhello\nEOF".
+func (t Task) heredocStr() string {
+	body := t.Stdin
+	if body != "" && !strings.HasSuffix(body, "\n") {
+		body += "\n"
+	}
+	return "<<" + t.Heredoc + "\n" + body + t.Heredoc
+}
+
 // String returns string that usable in crontab file.
 // In most cases, its output is not enough to re-construct a crontab file, because it is not included the environment variables.
 func (t Task) String() string {
@@ -139,6 +578,10 @@ func (t Task) CommandBin() string {
 // It is the arguments for command in most cases.
 // It includes stdin part.
 func (t Task) CommandArgs() string {
+	if t.Heredoc != "" {
+		args := strings.Fields(strings.ReplaceAll(t.Command, "%", "\\%"))[1:]
+		return strings.Join(append(args, t.heredocStr()), " ")
+	}
 	if len(strings.Fields(t.Command)) != 1 {
 		return strings.Join(strings.Fields(t.CommandWithStdin())[1:], " ")
 	}
@@ -149,7 +592,8 @@ func (t Task) CommandArgs() string {
 }
 
 // SplitTaskLine splits a task line in crontab.
-func SplitTaskLine(s string, includeUser bool) (schedule, user, command, stdin string, err error) {
+// If withSeconds is true, the schedule spec has six fields that starts with the seconds field.
+func SplitTaskLine(s string, includeUser, withSeconds bool) (schedule, user, command, stdin string, err error) {
 	xs := strings.Fields(s)
 	if len(xs) < 2 || (includeUser && len(xs) < 3) {
 		return "", "", "", "", ErrInvalidLine
@@ -167,11 +611,15 @@ func SplitTaskLine(s string, includeUser bool) (schedule, user, command, stdin s
 			xs = xs[1:]
 		}
 	} else {
-		if len(xs) < 6 || (includeUser && len(xs) < 7) {
+		n := 5
+		if withSeconds {
+			n = 6
+		}
+		if len(xs) < n+1 || (includeUser && len(xs) < n+2) {
 			return "", "", "", "", ErrInvalidLine
 		}
-		schedule = strings.Join(xs[:5], " ")
-		xs = xs[5:]
+		schedule = strings.Join(xs[:n], " ")
+		xs = xs[n:]
 	}
 
 	if includeUser {
@@ -206,6 +654,6 @@ func ParseCommand(s string) (command, stdin string) {
 
 // TaskReporter is a interface to StatusMonitor.
 type TaskReporter interface {
-	StartTask(t Task) (finish func(exitCode int, err error), stdout, stderr io.Writer)
+	StartTask(t Task, attempt int) (finish func(exitCode int, usage *ResourceUsage, err error), stdout, stderr io.Writer)
 	L() *zap.Logger
 }
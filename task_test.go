@@ -3,10 +3,12 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os/user"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -99,11 +101,15 @@ type TestTaskReporter struct {
 	Output   bytes.Buffer
 	ExitCode int
 	Err      error
+	Attempts int
+	Usage    *ResourceUsage
 	Logger   *zap.Logger
 }
 
-func (r *TestTaskReporter) StartTask(t Task) (finish func(int, error), stdout, stderr io.Writer) {
-	return func(exitCode int, err error) {
+func (r *TestTaskReporter) StartTask(t Task, attempt int) (finish func(int, *ResourceUsage, error), stdout, stderr io.Writer) {
+	r.Attempts = attempt
+	return func(exitCode int, usage *ResourceUsage, err error) {
+		r.Usage = usage
 		r.ExitCode = exitCode
 		r.Err = err
 	}, &r.Output, &r.Output
@@ -136,6 +142,7 @@ func TestTask_Run(t *testing.T) {
 			{"@echo \\%USER\\% \\%LOGNAME\\%", Environ{}, u.Username + " " + u.Username + "\r\n", 0},
 			{"*  @echo \\%USER\\% \\%LOGNAME\\%", Environ{"ENABLE_USER_COLUMN=yes"}, u.Username + " " + u.Username + "\r\n", 0},
 			{"@cd", Environ{"HOME=C:\\"}, "C:\\\r\n", 0},
+			{"@cd", Environ{"HOME=C:\\Windows", "WORKDIR=C:\\"}, "C:\\\r\n", 0},
 			{u.Username + "  @cd", Environ{"ENABLE_USER_COLUMN=enable"}, u.HomeDir + "\r\n", 0},
 			{"echo $env:SHELL", Environ{"SHELL=powershell.exe"}, "powershell.exe\r\n", 0},
 		}
@@ -147,6 +154,7 @@ func TestTask_Run(t *testing.T) {
 			{"echo $USER:$LOGNAME", Environ{}, u.Username + ":" + u.Username + "\n", 0},
 			{"*  echo $USER:$LOGNAME", Environ{"ENABLE_USER_COLUMN=yes"}, u.Username + ":" + u.Username + "\n", 0},
 			{"pwd", Environ{"HOME=/"}, "/\n", 0},
+			{"pwd; echo $PWD", Environ{"HOME=/tmp", "WORKDIR=/"}, "/\n/\n", 0},
 			{u.Username + "  pwd", Environ{"ENABLE_USER_COLUMN=enable"}, u.HomeDir + "\n", 0},
 			{"{printf \"hello \\%s\\n\", $1}%awk%", Environ{"SHELL=awk", "SHELL_OPTS="}, "hello awk\n", 0},
 			{"10 13", Environ{"SHELL=seq", "SHELL_OPTS=", "PARSE_COMMAND=yes"}, "10\n11\n12\n13\n", 0},
@@ -191,3 +199,284 @@ func TestTask_Run(t *testing.T) {
 		})
 	}
 }
+
+func TestTask_Run_timeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test uses sleep command")
+	}
+
+	tests := []struct {
+		Name    string
+		Command string
+		Env     Environ
+		Error   error
+		MaxTime time.Duration
+	}{
+		{"no-timeout", "sleep 0.1", Environ{}, nil, time.Second},
+		{"terminate", "sleep 5", Environ{"TIMEOUT=100ms"}, ErrTimeout, time.Second},
+		{"kill", "trap '' TERM; sleep 5", Environ{"TIMEOUT=100ms", "KILL_GRACE=100ms"}, ErrTimeout, time.Second},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.Name, func(t *testing.T) {
+			t.Parallel()
+
+			task, err := ParseTask("test", "@reboot "+tt.Command, tt.Env)
+			if err != nil {
+				t.Fatalf("failed to parse task: %s", err)
+			}
+
+			r := TestTaskReporter{Logger: NewTestLogger(t)}
+			stime := time.Now()
+			task.Run(context.Background(), &r)
+
+			if d := time.Since(stime); d > tt.MaxTime {
+				t.Errorf("took too long time: %s", d)
+			}
+
+			if !errors.Is(r.Err, tt.Error) {
+				t.Errorf("unexpected error: expected %v but got %v", tt.Error, r.Err)
+			}
+		})
+	}
+}
+
+func TestParseTask_invalidOption(t *testing.T) {
+	tests := []Environ{
+		{"TIMEOUT=1"},
+		{"KILL_GRACE=soon"},
+		{"CONCURRENCY_POLICY=whatever"},
+		{"RETRY_COUNT=-1"},
+		{"RETRY_COUNT=many"},
+		{"RETRY_BACKOFF=0.5"},
+		{"RANDOM_DELAY=-5"},
+		{"RANDOM_DELAY=sometime"},
+		{"NICE=100"},
+		{"IONICE_CLASS=fast"},
+		{"DST_POLICY=whatever"},
+		{"WORKDIR=relative/path"},
+		{"WORKDIR=/no/such/directory"},
+	}
+
+	for _, env := range tests {
+		t.Run(env[0], func(t *testing.T) {
+			if _, err := ParseTask("test", "@daily echo hello", env); err == nil {
+				t.Errorf("expected error but got nil")
+			}
+		})
+	}
+}
+
+func TestTask_Run_retry(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test uses sh syntax")
+	}
+
+	tests := []struct {
+		Command  string
+		Env      Environ
+		Attempts int
+		ExitCode int
+	}{
+		{"exit 0", Environ{"RETRY_COUNT=3", "RETRY_DELAY=10ms"}, 1, 0},
+		{"exit 1", Environ{}, 1, 1},
+		{"exit 1", Environ{"RETRY_COUNT=2", "RETRY_DELAY=10ms"}, 3, 1},
+		{"test $CONCRON_ATTEMPT -ge 3", Environ{"RETRY_COUNT=4", "RETRY_DELAY=10ms", "RETRY_BACKOFF=1.5"}, 3, 0},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(fmt.Sprintf("%s/%v", tt.Command, tt.Env), func(t *testing.T) {
+			t.Parallel()
+
+			task, err := ParseTask("test", "@reboot "+tt.Command, tt.Env)
+			if err != nil {
+				t.Fatalf("failed to parse task: %s", err)
+			}
+
+			r := TestTaskReporter{Logger: NewTestLogger(t)}
+			task.Run(context.Background(), &r)
+
+			if r.Attempts != tt.Attempts {
+				t.Errorf("unexpected attempts: expected %d but got %d", tt.Attempts, r.Attempts)
+			}
+
+			if r.ExitCode != tt.ExitCode {
+				t.Errorf("unexpected exit code: expected %d but got %d", tt.ExitCode, r.ExitCode)
+			}
+		})
+	}
+}
+
+func TestTask_nextRetryDelay(t *testing.T) {
+	tests := []struct {
+		Task   Task
+		Delay  time.Duration
+		Expect time.Duration
+	}{
+		{Task{RetryDelay: time.Second, RetryBackoff: 2}, time.Second, 2 * time.Second},
+		{Task{RetryDelay: time.Second, RetryBackoff: 1.5}, 10 * time.Second, 15 * time.Second},
+		{Task{RetryDelay: time.Second, RetryBackoff: 2}, 20 * time.Hour, MaxRetryDelay},
+		{Task{RetryDelay: time.Second, RetryBackoff: 1e10}, MaxRetryDelay, MaxRetryDelay},
+		{Task{RetryDelay: 48 * time.Hour, RetryBackoff: 2}, 48 * time.Hour, 48 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if d := tt.Task.nextRetryDelay(tt.Delay); d != tt.Expect {
+			t.Errorf("%s * %v: expected %s but got %s", tt.Delay, tt.Task.RetryBackoff, tt.Expect, d)
+		}
+	}
+}
+
+func TestParseTask_randomDelay(t *testing.T) {
+	tests := []struct {
+		Env    Environ
+		Delay  time.Duration
+		PerRun bool
+	}{
+		{Environ{}, 0, false},
+		{Environ{"RANDOM_DELAY=10"}, 10 * time.Minute, true},
+		{Environ{"RANDOM_DELAY=90s", "RANDOM_DELAY_STABLE=yes"}, 90 * time.Second, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.Env), func(t *testing.T) {
+			task, err := ParseTask("test", "@hourly echo hello", tt.Env)
+			if err != nil {
+				t.Fatalf("failed to parse task: %s", err)
+			}
+
+			if task.RandomDelay != tt.Delay {
+				t.Errorf("unexpected delay: expected %s but got %s", tt.Delay, task.RandomDelay)
+			}
+
+			s, ok := task.Schedule.(DelayedSchedule)
+			if tt.Delay == 0 {
+				if ok {
+					t.Errorf("schedule should not be delayed")
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("schedule is not delayed: %#v", task.Schedule)
+			}
+			if s.Max != tt.Delay || s.PerRun != tt.PerRun {
+				t.Errorf("unexpected schedule: %#v", s)
+			}
+		})
+	}
+}
+
+func TestParseTask_hash(t *testing.T) {
+	task, err := ParseTask("test", "H H(0-5) * * *  echo hello", Environ{})
+	if err != nil {
+		t.Fatalf("failed to parse task: %s", err)
+	}
+
+	if task.ScheduleSpec != "H H(0-5) * * *" {
+		t.Errorf("unexpected schedule spec: %q", task.ScheduleSpec)
+	}
+	if task.ResolvedSpec == task.ScheduleSpec || strings.ContainsRune(task.ResolvedSpec, 'H') {
+		t.Errorf("schedule spec is not resolved: %q", task.ResolvedSpec)
+	}
+
+	again, err := ParseTask("test", task.String(), Environ{})
+	if err != nil {
+		t.Fatalf("failed to parse task again: %s", err)
+	}
+	if again.ResolvedSpec != task.ResolvedSpec {
+		t.Errorf("resolved spec is not stable: %q and %q", task.ResolvedSpec, again.ResolvedSpec)
+	}
+}
+
+func TestParseTask_seconds(t *testing.T) {
+	tests := []struct {
+		Input    string
+		Env      Environ
+		Schedule string
+		Command  string
+		From     string
+		Next     string
+	}{
+		{"*/15 * * * * *  echo hello", Environ{"SCHEDULE_SECONDS=yes"}, "*/15 * * * * *", "echo hello", "2022-01-02T15:04:05Z", "2022-01-02T15:04:15Z"},
+		{"30 0 * * * *  root  date", Environ{"SCHEDULE_SECONDS=yes", "ENABLE_USER_COLUMN=yes"}, "30 0 * * * *", "date", "2022-01-02T15:04:05Z", "2022-01-02T16:00:30Z"},
+		{"@every 10s  echo hello", Environ{"SCHEDULE_SECONDS=yes"}, "@every 10s", "echo hello", "2022-01-02T15:04:05Z", "2022-01-02T15:04:15Z"},
+		{"@hourly  echo hello", Environ{"SCHEDULE_SECONDS=yes"}, "@hourly", "echo hello", "2022-01-02T15:04:05Z", "2022-01-02T16:00:00Z"},
+		{"*/15 * * * * *  echo hello", Environ{}, "*/15 * * * *", "* echo hello", "2022-01-02T15:04:05Z", "2022-01-02T15:15:00Z"},
+		{"0 0 9 * * *  echo hello", Environ{"SCHEDULE_SECONDS=yes", "CRON_TZ=Asia/Tokyo"}, "0 0 9 * * *", "echo hello", "2022-01-02T15:04:05Z", "2022-01-03T00:00:00Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Input, func(t *testing.T) {
+			task, err := ParseTask("test", tt.Input, tt.Env)
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+
+			if task.ScheduleSpec != tt.Schedule {
+				t.Errorf("unexpected schedule\nexpected: %q\n but got: %q", tt.Schedule, task.ScheduleSpec)
+			}
+
+			if task.Command != tt.Command {
+				t.Errorf("unexpected command\nexpected: %q\n but got: %q", tt.Command, task.Command)
+			}
+
+			from, _ := time.Parse(time.RFC3339, tt.From)
+			expected, _ := time.Parse(time.RFC3339, tt.Next)
+			if next := task.Schedule.Next(from); !next.Equal(expected) {
+				t.Errorf("unexpected next time\nexpected: %s\n but got: %s", expected, next)
+			}
+		})
+	}
+}
+
+func TestParseTask_seconds_invalid(t *testing.T) {
+	tests := []string{
+		"* * * * *  echo hello",
+		"60 * * * * *  echo hello",
+	}
+
+	for _, tt := range tests {
+		t.Run(tt, func(t *testing.T) {
+			if _, err := ParseTask("test", tt, Environ{"SCHEDULE_SECONDS=yes"}); err == nil {
+				t.Errorf("expected error but got nil")
+			}
+		})
+	}
+}
+
+func TestTask_Missed(t *testing.T) {
+	now := time.Date(2021, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		Spec   string
+		Env    Environ
+		Last   time.Time
+		Missed time.Time
+	}{
+		{"0 3 * * *", Environ{"CATCH_UP=yes"}, time.Date(2021, 1, 2, 3, 0, 0, 0, time.UTC), time.Time{}},
+		{"0 3 * * *", Environ{"CATCH_UP=yes"}, time.Date(2021, 1, 1, 3, 0, 0, 0, time.UTC), time.Date(2021, 1, 2, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * *", Environ{"CATCH_UP=yes"}, time.Date(2020, 12, 1, 3, 0, 0, 0, time.UTC), time.Date(2021, 1, 2, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * *", Environ{"CATCH_UP=6h"}, time.Date(2021, 1, 1, 3, 0, 0, 0, time.UTC), time.Time{}},
+		{"0 3 * * *", Environ{"CATCH_UP=24h"}, time.Date(2021, 1, 1, 3, 0, 0, 0, time.UTC), time.Date(2021, 1, 2, 3, 0, 0, 0, time.UTC)},
+		{"*/10 * * * *", Environ{"CATCH_UP=yes"}, time.Date(2021, 1, 2, 14, 55, 0, 0, time.UTC), time.Date(2021, 1, 2, 15, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s/%s", tt.Spec, tt.Env, tt.Last), func(t *testing.T) {
+			task, err := ParseTask("test", tt.Spec+" echo hello", append(tt.Env, "TZ=UTC"))
+			if err != nil {
+				t.Fatalf("failed to parse task: %s", err)
+			}
+			if !task.CatchUp {
+				t.Fatalf("CatchUp is not enabled")
+			}
+
+			missed, ok := task.Missed(tt.Last, now)
+			if ok != !tt.Missed.IsZero() || !missed.Equal(tt.Missed) {
+				t.Errorf("expected %s but got %s (%v)", tt.Missed, missed, ok)
+			}
+		})
+	}
+}
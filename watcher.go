@@ -19,6 +19,7 @@ type CrontabWatcher struct {
 
 	scheduler   *Scheduler
 	modtime     time.Time
+	includes    map[string]time.Time
 	size        int
 	entries     []cron.EntryID
 	observeTask cron.EntryID
@@ -46,7 +47,7 @@ func (w *CrontabWatcher) readCrontab() (Crontab, time.Time, error) {
 		return Crontab{}, time.Time{}, err
 	}
 
-	ct, err := ParseCrontab(w.Path, f, GetEnviron())
+	ct, err := ParseCrontabFile(w.Path, f, GetEnviron())
 	return ct, stat.ModTime(), err
 }
 
@@ -65,12 +66,37 @@ func (w *CrontabWatcher) load(ctx context.Context, onReboot bool) error {
 	w.scheduler.Unregister(w.entries...)
 	w.entries = w.scheduler.RegisterCrontab(ct, onReboot)
 
+	// The initial load can't prune, because other crontabs are not loaded yet.
+	if !onReboot {
+		w.scheduler.PruneState()
+	}
+
 	finish(ct, nil)
 
 	w.modtime = modtime
+	w.includes = make(map[string]time.Time)
+	for _, p := range ct.IncludedFiles {
+		if stat, err := os.Stat(p); err == nil {
+			w.includes[p] = stat.ModTime()
+		}
+	}
 	return nil
 }
 
+// includesChanged checks if any file included by the crontab has changed since the last load.
+func (w *CrontabWatcher) includesChanged() bool {
+	w.Lock()
+	defer w.Unlock()
+
+	for p, modtime := range w.includes {
+		stat, err := os.Stat(p)
+		if err != nil || !stat.ModTime().Equal(modtime) {
+			return true
+		}
+	}
+	return false
+}
+
 // Register registers watcher task to observe crontab file's changes.
 // If the crontab file removed, the watcher automatically unregister itself.
 func (w *CrontabWatcher) Register(ctx context.Context) {
@@ -84,7 +110,7 @@ func (w *CrontabWatcher) Register(ctx context.Context) {
 			return
 		}
 
-		if stat.ModTime().After(w.modtime) {
+		if stat.ModTime().After(w.modtime) || w.includesChanged() {
 			w.load(ctx, false)
 		}
 	})
@@ -97,6 +123,7 @@ func (w *CrontabWatcher) Close() error {
 
 	w.scheduler.Unregister(w.observeTask)
 	w.scheduler.Unregister(w.entries...)
+	w.scheduler.PruneState()
 	w.observeTask = 0
 
 	w.Monitor.Unloaded(w.Path)
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCrontabWatcher_includes(t *testing.T) {
+	dir := t.TempDir()
+	crontab := filepath.Join(dir, "crontab")
+	common := filepath.Join(dir, "common.env")
+
+	if err := os.WriteFile(common, []byte("GREETING=hello"), 0644); err != nil {
+		t.Fatalf("failed to write include: %s", err)
+	}
+	if err := os.WriteFile(crontab, []byte("@include common.env\n@daily echo $GREETING"), 0644); err != nil {
+		t.Fatalf("failed to write crontab: %s", err)
+	}
+
+	sm := NewStatusMonitor(NewTestLogger(t))
+	s := NewScheduler(context.Background(), sm, nil)
+	w, err := NewCrontabWatcher(context.Background(), s, sm, crontab, false)
+	if err != nil {
+		t.Fatalf("failed to load crontab: %s", err)
+	}
+	defer w.Close()
+
+	greeting := func() string {
+		st := sm.Status()
+		if len(st) != 1 || len(st[0].Tasks) != 1 {
+			t.Fatalf("unexpected status: %v", st)
+		}
+		return st[0].Tasks[0].Env.Get("GREETING", "")
+	}
+
+	if g := greeting(); g != "hello" {
+		t.Fatalf("unexpected GREETING: %q", g)
+	}
+	if w.includesChanged() {
+		t.Errorf("includes changed without modification")
+	}
+
+	if err := os.WriteFile(common, []byte("GREETING=world"), 0644); err != nil {
+		t.Fatalf("failed to write include: %s", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(common, later, later); err != nil {
+		t.Fatalf("failed to change modtime: %s", err)
+	}
+	if !w.includesChanged() {
+		t.Fatalf("includes not changed after modification")
+	}
+
+	if err := w.load(context.Background(), false); err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+	if g := greeting(); g != "world" {
+		t.Errorf("unexpected GREETING after reload: %q", g)
+	}
+	if w.includesChanged() {
+		t.Errorf("includes changed after reload")
+	}
+
+	if err := os.Remove(common); err != nil {
+		t.Fatalf("failed to remove include: %s", err)
+	}
+	if !w.includesChanged() {
+		t.Errorf("includes not changed after remove")
+	}
+}
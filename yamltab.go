@@ -0,0 +1,431 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrInvalidYAML  = errors.New("invalid YAML crontab")
+	ErrUnknownField = errors.New("unknown field")
+	ErrMissingField = errors.New("missing required field")
+)
+
+// IsYAMLCrontab checks if the path is a YAML crontab file or not, by its extension.
+func IsYAMLCrontab(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return true
+	default:
+		return false
+	}
+}
+
+// ParseYAMLCrontab parses a YAML crontab file like below.
+//
+//	env:
+//	  SHELL: /bin/bash
+//	jobs:
+//	  - name: backup
+//	    schedule: "0 3 * * *"
+//	    args: [/usr/local/bin/backup, --full]
+//	    options:
+//	      timeout: 1h
+//
+// The errors include the line number and the YAML path of the wrong field, like "5: jobs[0].options.timeout: ...".
+func ParseYAMLCrontab(path string, r io.Reader, env Environ) (Crontab, error) {
+	p := yamlParser{
+		crontab: Crontab{Path: path},
+		env:     append(Environ{}, env...),
+		origins: make(yamlOrigins),
+	}
+
+	var doc yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&doc); err == io.EOF {
+		return p.crontab, nil
+	} else if err != nil {
+		return Crontab{}, fmt.Errorf("%w: %s", ErrInvalidYAML, err)
+	}
+
+	if err := p.parse(doc.Content[0]); err != nil {
+		return Crontab{}, err
+	}
+
+	if err := p.crontab.checkDependencies(p.lines); err != nil {
+		return Crontab{}, err
+	}
+
+	if err := p.crontab.checkGroups(p.lines); err != nil {
+		return Crontab{}, err
+	}
+
+	return p.crontab, nil
+}
+
+// yamlParser is the state of parsing a YAML crontab file.
+type yamlParser struct {
+	crontab Crontab
+	env     Environ
+	origins yamlOrigins
+	secrets []string
+	lines   []int
+}
+
+// yamlOrigin is the field that sets an environment variable or an option.
+type yamlOrigin struct {
+	node *yaml.Node
+	path string
+}
+
+// yamlOrigins is the map from the environment variable names to the fields that set them, to report errors at the right field.
+type yamlOrigins map[string]yamlOrigin
+
+func (o yamlOrigins) clone() yamlOrigins {
+	c := make(yamlOrigins, len(o))
+	for k, v := range o {
+		c[k] = v
+	}
+	return c
+}
+
+// yamlError makes an error that points to the node.
+func yamlError(node *yaml.Node, path string, err error) error {
+	if path == "" {
+		return fmt.Errorf("%d: %w", node.Line, err)
+	}
+	return fmt.Errorf("%d: %s: %w", node.Line, path, err)
+}
+
+// yamlFields returns the pairs of key and value in the mapping node, and checks all keys are known.
+func yamlFields(node *yaml.Node, path string, known ...string) ([][2]*yaml.Node, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, yamlError(node, path, fmt.Errorf("%w: expected mapping", ErrInvalidYAML))
+	}
+
+	var fs [][2]*yaml.Node
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		if v.Kind == yaml.AliasNode {
+			v = v.Alias
+		}
+
+		if known != nil {
+			ok := false
+			for _, x := range known {
+				ok = ok || k.Value == x
+			}
+			if !ok {
+				return nil, yamlError(k, joinYAMLPath(path, k.Value), ErrUnknownField)
+			}
+		}
+
+		fs = append(fs, [2]*yaml.Node{k, v})
+	}
+	return fs, nil
+}
+
+// yamlString returns the value of the scalar node.
+func yamlString(node *yaml.Node, path string) (string, error) {
+	if node.Kind != yaml.ScalarNode {
+		return "", yamlError(node, path, fmt.Errorf("%w: expected string", ErrInvalidYAML))
+	}
+	if node.Tag == "!!null" {
+		return "", nil
+	}
+	return node.Value, nil
+}
+
+var simpleYAMLKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// joinYAMLPath returns the path to the child field, like "jobs[0].env.FOO".
+func joinYAMLPath(path, key string) string {
+	if !simpleYAMLKey.MatchString(key) {
+		key = fmt.Sprintf("%q", key)
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func (p *yamlParser) parse(root *yaml.Node) error {
+	fields, err := yamlFields(root, "", "env", "jobs")
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		if f[0].Value == "env" {
+			if p.env, err = p.parseEnv(f[1], "env", p.env, p.origins); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, f := range fields {
+		if f[0].Value != "jobs" {
+			continue
+		}
+
+		if f[1].Kind != yaml.SequenceNode {
+			return yamlError(f[1], "jobs", fmt.Errorf("%w: expected list", ErrInvalidYAML))
+		}
+		for i, job := range f[1].Content {
+			if job.Kind == yaml.AliasNode {
+				job = job.Alias
+			}
+			t, err := p.parseJob(job, fmt.Sprintf("jobs[%d]", i))
+			if err != nil {
+				return err
+			}
+			if p.crontab.add(t) {
+				p.lines = append(p.lines, job.Line)
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseEnv parses a mapping of environment variables and returns a new Environ that based on the env.
+// The variables are expanded following EXPAND_ENV, as the same as crontab.
+// The fields of the variables are recorded to the origins.
+func (p *yamlParser) parseEnv(node *yaml.Node, path string, env Environ, origins yamlOrigins) (Environ, error) {
+	fields, err := yamlFields(node, path)
+	if err != nil {
+		return nil, err
+	}
+
+	env = append(Environ{}, env...)
+	for _, f := range fields {
+		keyPath := joinYAMLPath(path, f[0].Value)
+		if !IsValidKey(f[0].Value) {
+			return nil, yamlError(f[0], keyPath, fmt.Errorf("%w: invalid variable name", ErrInvalidYAML))
+		}
+		v, err := yamlString(f[1], keyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		mode, err := ParseExpandMode(env.Get("EXPAND_ENV", ""))
+		if err != nil {
+			return nil, yamlError(f[1], keyPath, err)
+		}
+		x := &expander{env: env, mode: mode}
+		if v, err = x.expand(v); err != nil {
+			return nil, yamlError(f[1], keyPath, err)
+		}
+		p.secrets = append(p.secrets, x.secrets...)
+
+		env.set(f[0].Value, v)
+		origins[f[0].Value] = yamlOrigin{f[1], keyPath}
+
+		if f[0].Value == "EXPAND_ENV" {
+			if _, err := ParseExpandMode(v); err != nil {
+				return nil, yamlError(f[1], keyPath, err)
+			}
+		}
+	}
+	return env, nil
+}
+
+// parseJob parses a job in the jobs list.
+func (p *yamlParser) parseJob(node *yaml.Node, path string) (Task, error) {
+	fields, err := yamlFields(node, path, "name", "schedule", "user", "command", "args", "stdin", "env", "options")
+	if err != nil {
+		return Task{}, err
+	}
+
+	var (
+		spec, user, command, stdin string
+		specNode, commandNode      *yaml.Node
+		nameNode, envNode, optNode *yaml.Node
+	)
+	for _, f := range fields {
+		fieldPath := joinYAMLPath(path, f[0].Value)
+		switch f[0].Value {
+		case "name":
+			nameNode = f[1]
+		case "schedule":
+			specNode = f[1]
+			if spec, err = yamlString(f[1], fieldPath); err != nil {
+				return Task{}, err
+			}
+			spec = strings.Join(strings.Fields(spec), " ")
+		case "user":
+			if user, err = yamlString(f[1], fieldPath); err != nil {
+				return Task{}, err
+			}
+		case "command", "args":
+			if commandNode != nil {
+				return Task{}, yamlError(f[0], fieldPath, fmt.Errorf("%w: command and args can not be used together", ErrInvalidYAML))
+			}
+			commandNode = f[1]
+			if f[0].Value == "command" {
+				command, err = yamlString(f[1], fieldPath)
+			} else {
+				command, err = yamlArgs(f[1], fieldPath)
+			}
+			if err != nil {
+				return Task{}, err
+			}
+			command = strings.TrimSpace(command)
+		case "stdin":
+			if stdin, err = yamlString(f[1], fieldPath); err != nil {
+				return Task{}, err
+			}
+		case "env":
+			envNode = f[1]
+		case "options":
+			optNode = f[1]
+		}
+	}
+
+	if specNode == nil || spec == "" {
+		return Task{}, yamlError(node, joinYAMLPath(path, "schedule"), ErrMissingField)
+	}
+	if commandNode == nil || command == "" {
+		return Task{}, yamlError(node, joinYAMLPath(path, "command"), ErrMissingField)
+	}
+	if user == "" {
+		user = "*"
+	}
+
+	env := append(Environ{}, p.env...)
+	origins := p.origins.clone()
+	if envNode != nil {
+		if env, err = p.parseEnv(envNode, joinYAMLPath(path, "env"), env, origins); err != nil {
+			return Task{}, err
+		}
+	}
+	if optNode != nil {
+		if env, err = p.parseOptions(optNode, joinYAMLPath(path, "options"), env, origins); err != nil {
+			return Task{}, err
+		}
+	}
+	if nameNode != nil {
+		name, err := yamlString(nameNode, joinYAMLPath(path, "name"))
+		if err != nil {
+			return Task{}, err
+		}
+		env.set("NAME", name)
+		origins["NAME"] = yamlOrigin{nameNode, joinYAMLPath(path, "name")}
+	}
+
+	// Check the options one by one, to report which field is wrong.
+	for _, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || !isOptionName(kv[0]) {
+			continue
+		}
+		if err := checkOption(kv[0], kv[1], env); err != nil {
+			if o, ok := origins[kv[0]]; ok {
+				return Task{}, yamlError(o.node, o.path, err)
+			}
+			return Task{}, yamlError(node, path, err)
+		}
+	}
+
+	t, err := NewTask(p.crontab.Path, spec, user, command, stdin, env)
+	if err != nil {
+		// The options are valid here, so the error is in the schedule, or the AFTER option that conflicts with the schedule.
+		if errors.Is(err, ErrInvalidAfter) && spec != "@after" {
+			for _, k := range []string{"AFTER", "AFTER_FAILURE"} {
+				if o, ok := origins[k]; ok && env.Get(k, "") != "" {
+					return Task{}, yamlError(o.node, o.path, err)
+				}
+			}
+		}
+		return Task{}, yamlError(specNode, joinYAMLPath(path, "schedule"), err)
+	}
+	t.SetSecrets(p.secrets)
+	return t, nil
+}
+
+// parseOptions parses the options of a job, that use the same keys as the structured comments in crontab.
+// The fields of the options are recorded to the origins.
+func (p *yamlParser) parseOptions(node *yaml.Node, path string, env Environ, origins yamlOrigins) (Environ, error) {
+	fields, err := yamlFields(node, path)
+	if err != nil {
+		return nil, err
+	}
+
+	env = append(Environ{}, env...)
+	for _, f := range fields {
+		optPath := joinYAMLPath(path, f[0].Value)
+		key, ok := optionKeys[strings.ToLower(f[0].Value)]
+		if !ok {
+			return nil, yamlError(f[0], optPath, ErrUnknownOption)
+		}
+		v, err := yamlString(f[1], optPath)
+		if err != nil {
+			return nil, err
+		}
+		env.set(key, v)
+		origins[key] = yamlOrigin{f[1], optPath}
+	}
+	return env, nil
+}
+
+// isOptionName checks if the environment variable name is one of the options.
+func isOptionName(name string) bool {
+	for _, x := range optionKeys {
+		if x == name {
+			return true
+		}
+	}
+	return false
+}
+
+// optionDependencies is the variables that needed to check the option.
+var optionDependencies = map[string][]string{
+	"SKIP_CALENDAR": {"TZ", "CRON_TZ"},
+	"IONICE_LEVEL":  {"IONICE_CLASS"},
+}
+
+// checkOption checks a value of an option without the other options, to know which option is wrong.
+// Only the variables in optionDependencies are taken from the env.
+func checkOption(key, value string, env Environ) error {
+	opts := Environ{key + "=" + value}
+	for _, k := range optionDependencies[key] {
+		if v := env.Get(k, ""); v != "" {
+			opts.set(k, v)
+		}
+	}
+
+	var dummy Task
+	return dummy.parseOptions(opts)
+}
+
+// yamlArgs makes a command from a list of arguments, quoting them like the POSIX shell.
+func yamlArgs(node *yaml.Node, path string) (string, error) {
+	if node.Kind != yaml.SequenceNode {
+		return "", yamlError(node, path, fmt.Errorf("%w: expected list", ErrInvalidYAML))
+	}
+
+	args := make([]string, len(node.Content))
+	for i, x := range node.Content {
+		s, err := yamlString(x, fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			return "", err
+		}
+		args[i] = shellQuote(s)
+	}
+	return strings.Join(args, " "), nil
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote quotes the string for the POSIX shell if needed.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
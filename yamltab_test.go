@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsYAMLCrontab(t *testing.T) {
+	tests := map[string]bool{
+		"/etc/cron.d/jobs.yaml": true,
+		"/etc/cron.d/jobs.YML":  true,
+		"/etc/cron.d/jobs":      false,
+		"/etc/crontab":          false,
+		"/etc/cron.d/yaml":      false,
+	}
+
+	for path, expected := range tests {
+		if actual := IsYAMLCrontab(path); actual != expected {
+			t.Errorf("%s: expected %v but got %v", path, expected, actual)
+		}
+	}
+}
+
+func TestParseYAMLCrontab(t *testing.T) {
+	ct, err := ParseYAMLCrontab("/path/to/jobs.yaml", strings.NewReader(strings.Join([]string{
+		"env:",
+		"  SHELL: sh",
+		"  TIMEOUT: 10m",
+		"jobs:",
+		"  - name: backup",
+		"    schedule: 0 3 * * *",
+		"    args: [/usr/local/bin/backup, --dest, /mnt/my backup, \"it's\"]",
+		"    options:",
+		"      timeout: 1h",
+		"      retries: 2",
+		"  - schedule: '@after'",
+		"    user: admin",
+		"    command: cat",
+		"    stdin: |",
+		"      50%",
+		"      done",
+		"    env:",
+		"      FOO: bar",
+		"    options:",
+		"      after: backup",
+	}, "\n")), Environ{"TZ=UTC"})
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+
+	if len(ct.Tasks) != 2 {
+		t.Fatalf("expected 2 tasks but got %d", len(ct.Tasks))
+	}
+
+	backup := ct.Tasks[0]
+	if s := backup.String(); s != `0 3 * * *  /usr/local/bin/backup --dest '/mnt/my backup' 'it'\''s'` {
+		t.Errorf("unexpected task: %s", s)
+	}
+	if backup.Name != "backup" || backup.Timeout != time.Hour || backup.RetryCount != 2 || backup.Source != "/path/to/jobs.yaml" {
+		t.Errorf("unexpected options: %#v", backup)
+	}
+	if v := backup.Env.Get("SHELL", ""); v != "sh" {
+		t.Errorf("unexpected SHELL: %q", v)
+	}
+
+	cat := ct.Tasks[1]
+	if cat.User != "admin" || cat.Command != "cat" || cat.Stdin != "50%\ndone\n" || cat.After != "backup" || cat.Timeout != 10*time.Minute {
+		t.Errorf("unexpected task: %#v", cat)
+	}
+	if v := cat.Env.Get("FOO", ""); v != "bar" {
+		t.Errorf("unexpected FOO: %q", v)
+	}
+	if v := backup.Env.Get("FOO", ""); v != "" {
+		t.Errorf("env of a job leaked to another job: %q", v)
+	}
+
+	if deps := ct.Dependencies(); len(deps) != 1 || deps[0].Upstream != "backup" {
+		t.Errorf("unexpected dependencies: %v", deps)
+	}
+}
+
+func TestParseYAMLCrontab_dependentOptions(t *testing.T) {
+	ct, err := ParseYAMLCrontab("/path/to/jobs.yaml", strings.NewReader(strings.Join([]string{
+		"env:",
+		"  IONICE_CLASS: best-effort",
+		"jobs:",
+		"  - schedule: '@daily'",
+		"    command: echo",
+		"    options:",
+		"      ionice_level: 7",
+	}, "\n")), Environ{})
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if p := ct.Tasks[0].Priority; p.IOLevel != 7 {
+		t.Errorf("unexpected priority: %#v", p)
+	}
+}
+
+func TestParseYAMLCrontab_empty(t *testing.T) {
+	ct, err := ParseYAMLCrontab("/path/to/jobs.yaml", strings.NewReader("# nothing here\n"), Environ{})
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if len(ct.Tasks) != 0 {
+		t.Errorf("unexpected tasks: %v", ct.Tasks)
+	}
+}
+
+func TestParseYAMLCrontab_invalid(t *testing.T) {
+	tests := []struct {
+		Input string
+		Error error
+		Path  string
+	}{
+		{"jobs: [", ErrInvalidYAML, ""},
+		{"- echo hello", ErrInvalidYAML, "1: invalid"},
+		{"jobs:\n  - schedule: '@daily'\n    command: echo\n    colour: red", ErrUnknownField, "4: jobs[0].colour: "},
+		{"jobs:\n  - command: echo hello", ErrMissingField, "2: jobs[0].schedule: "},
+		{"jobs:\n  - schedule: '@daily'", ErrMissingField, "2: jobs[0].command: "},
+		{"jobs:\n  - schedule: '@daily'\n    command: echo\n    args: [echo]", ErrInvalidYAML, "4: jobs[0].args: "},
+		{"jobs:\n  - schedule: '@daily'\n    args: [echo, [x]]", ErrInvalidYAML, "3: jobs[0].args[1]: "},
+		{"jobs:\n  - schedule: '@daily'\n    command: echo\n    options:\n      colour: red", ErrUnknownOption, "5: jobs[0].options.colour: "},
+		{"jobs:\n  - schedule: '@daily'\n    command: echo\n  - schedule: '@daily'\n    command: echo\n    options:\n      timeout: soon", nil, "7: jobs[1].options.timeout: "},
+		{"jobs:\n  - schedule: '@daily'\n    command: echo\n    env:\n      EXPAND_ENV: strict\n      X: $MISSING", ErrUndefinedVariable, "6: jobs[0].env.X: "},
+		{"env:\n  EXPAND_ENV: bogus\njobs:\n  - schedule: '@daily'\n    command: echo", ErrInvalidExpandMode, "2: env.EXPAND_ENV: "},
+		{"jobs:\n  - schedule: 61 * * * *\n    command: echo", nil, "2: jobs[0].schedule: "},
+		{"jobs:\n  - schedule: '@daily'\n    command: echo\n    options:\n      after: x", ErrInvalidAfter, "5: jobs[0].options.after: "},
+		{"jobs:\n  - schedule: '@after'\n    command: echo", ErrInvalidAfter, "2: jobs[0].schedule: "},
+		{"env:\n  TIMEOUT: soon\njobs:\n  - schedule: '@daily'\n    command: echo", nil, "2: env.TIMEOUT: "},
+		{"jobs:\n  - schedule: '@daily'\n    command: echo\n    env:\n      TIMEOUT: soon", nil, "5: jobs[0].env.TIMEOUT: "},
+		{"jobs:\n  - schedule: '@daily'\n    command: echo\n    env:\n      IONICE_CLASS: idle\n    options:\n      ionice_level: 3", nil, "7: jobs[0].options.ionice_level: "},
+		{"jobs:\n  - schedule: '@daily'\n    command: echo\n    options:\n      concurrency_limit: 0", ErrInvalidGroupLimit, "5: jobs[0].options.concurrency_limit: "},
+		{"jobs:\n  - name: a\n    schedule: '@daily'\n    command: echo a\n  - name: a\n    schedule: '@daily'\n    command: echo b", ErrDuplicatedName, "5: "},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseYAMLCrontab("/path/to/jobs.yaml", strings.NewReader(tt.Input), Environ{})
+		if err == nil {
+			t.Errorf("%q: expected error", tt.Input)
+			continue
+		}
+		if tt.Error != nil && !errors.Is(err, tt.Error) {
+			t.Errorf("%q: expected %v but got %v", tt.Input, tt.Error, err)
+		}
+		if !strings.HasPrefix(err.Error(), tt.Path) {
+			t.Errorf("%q: expected error at %q but got %q", tt.Input, tt.Path, err)
+		}
+	}
+}
+
+func TestParseCrontabFile(t *testing.T) {
+	yml := "jobs:\n  - schedule: '@daily'\n    command: echo hello"
+
+	if ct, err := ParseCrontabFile("/path/to/jobs.yml", strings.NewReader(yml), Environ{}); err != nil || len(ct.Tasks) != 1 {
+		t.Errorf("failed to parse YAML crontab: %v", err)
+	}
+	if _, err := ParseCrontabFile("/path/to/crontab", strings.NewReader(yml), Environ{}); !errors.Is(err, ErrInvalidLine) {
+		t.Errorf("YAML is parsed as a crontab: %v", err)
+	}
+}